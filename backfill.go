@@ -0,0 +1,153 @@
+package collectdvsphere
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/event"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultBackfillReadPeriod is how much of the time range to backfill is read
+// from vSphere at once, so that a long time range doesn't have to fit into
+// memory.
+const defaultBackfillReadPeriod = time.Hour
+
+// NewBackfillStatsCollector returns a StatsCollector with no stats for a
+// VSphereEventListener that's only used to Backfill. Unlike the other
+// StatsCollectors, it never writes its stats on its own.
+func NewBackfillStatsCollector(writer MetricWriter, interval time.Duration, logger logrus.FieldLogger, collectdPluginInstance string) *StatsCollector {
+	return newStatsCollector(writer, interval, logger, collectdPluginInstance)
+}
+
+// Backfill reads the events that happened on the configured clusters between
+// from and to, and writes the metrics they result in to the sinks of the
+// listener's StatsCollector. The metrics are written once per interval of the
+// StatsCollector, with the end of the interval as their timestamp, as if they
+// had been collected at the time.
+//
+// The counters written by Backfill start at zero at from, and the listener's
+// own StatsCollector isn't changed.
+func (l *VSphereEventListener) Backfill(ctx context.Context, from, to time.Time) error {
+	if !from.Before(to) {
+		return errors.Errorf("backfill start time %s is not before end time %s", from, to)
+	}
+
+	config := l.config
+	config.CheckpointPath = ""
+
+	collector := newStatsCollector(nil, l.statsCollector.interval, l.logger, l.statsCollector.collectdPluginInstance)
+	for _, sink := range l.statsCollector.sinkList() {
+		collector.addSink(sink.name, sink.writer)
+	}
+	backfiller := NewVSphereEventListener(config, collector, l.logger)
+
+	return backfiller.backfill(ctx, from, to)
+}
+
+func (l *VSphereEventListener) backfill(ctx context.Context, from, to time.Time) error {
+	err := l.makeClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create vSphere client")
+	}
+	defer l.closeClient()
+
+	err = l.prefillHosts(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't prefill hosts")
+	}
+	err = l.prefillBaseVMs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't prefill base VMs")
+	}
+
+	clusterRefs, err := l.clusterReferences(ctx)
+	if err != nil {
+		return err
+	}
+
+	eventManager := event.NewManager(l.client.Client)
+	read := func(ctx context.Context, from, to time.Time) ([]types.BaseEvent, error) {
+		var events []types.BaseEvent
+		for _, clusterRef := range clusterRefs {
+			clusterEvents, err := readEvents(ctx, eventManager, clusterRef, &from, &to)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read events for compute cluster with ID %s", clusterRef)
+			}
+			events = append(events, clusterEvents...)
+		}
+
+		l.logger.WithFields(logrus.Fields{
+			"from":        from,
+			"to":          to,
+			"event_count": len(events),
+		}).Info("backfilling events")
+
+		return events, nil
+	}
+
+	return l.backfillEvents(ctx, read, from, to)
+}
+
+// backfillEvents handles the events that happened in each interval between
+// from and to, and then writes the metrics with the end of the interval as
+// their timestamp. The events are read with read a few intervals at a time.
+// Events that are read twice, because they happened at the end of one read
+// and the start of the next, are only counted once.
+func (l *VSphereEventListener) backfillEvents(ctx context.Context, read func(ctx context.Context, from, to time.Time) ([]types.BaseEvent, error), from, to time.Time) error {
+	interval := l.statsCollector.interval
+	intervalEnd := from.Truncate(interval).Add(interval)
+
+	for readFrom := from; ; {
+		readTo := intervalEnd
+		for readTo.Sub(readFrom) < l.backfillReadPeriod && readTo.Before(to) {
+			readTo = readTo.Add(interval)
+		}
+		if readTo.After(to) {
+			readTo = to
+		}
+
+		events, err := read(ctx, readFrom, readTo)
+		if err != nil {
+			return err
+		}
+
+		// The events are split into intervals by when they happened, so
+		// they have to be in that order rather than in the order of their
+		// keys.
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].GetEvent().CreatedTime.Before(events[j].GetEvent().CreatedTime)
+		})
+
+		for ; ; intervalEnd = intervalEnd.Add(interval) {
+			i := 0
+			for i < len(events) && !events[i].GetEvent().CreatedTime.After(intervalEnd) {
+				i++
+			}
+
+			err := l.handleEvents(ctx, events[:i], false)
+			if err != nil {
+				return errors.Wrap(err, "failed to handle events")
+			}
+			events = events[i:]
+
+			err = l.statsCollector.writeAt(intervalEnd)
+			if err != nil {
+				return errors.Wrapf(err, "failed to write metrics for %s", intervalEnd)
+			}
+
+			if !intervalEnd.Before(to) {
+				return nil
+			}
+			if !intervalEnd.Before(readTo) {
+				break
+			}
+		}
+
+		readFrom = readTo
+		intervalEnd = intervalEnd.Add(interval)
+	}
+}
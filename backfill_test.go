@@ -0,0 +1,101 @@
+package collectdvsphere
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+
+	"collectd.org/api"
+)
+
+type timedAPIWriter struct {
+	valueLists []api.ValueList
+}
+
+func (w *timedAPIWriter) Write(vl api.ValueList) error {
+	w.valueLists = append(w.valueLists, vl)
+	return nil
+}
+
+func TestVSphereEventListenerBackfillIntervals(t *testing.T) {
+	apiWriter := &timedAPIWriter{}
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(NewCollectdWriter(apiWriter), time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+	listener.backfillReadPeriod = 90 * time.Second
+
+	from := time.Date(2017, 1, 2, 3, 0, 10, 0, time.UTC)
+	to := time.Date(2017, 1, 2, 3, 3, 0, 0, time.UTC)
+
+	host := hostArg("backfill-host")
+	poweredOff := func(key int32, createdTime time.Time) types.BaseEvent {
+		e := &types.VmPoweredOffEvent{}
+		e.Key = key
+		e.CreatedTime = createdTime
+		e.Host = &host
+		return e
+	}
+
+	// An event at the end of an interval belongs to that interval, and events
+	// are put into intervals by when they happened, not by their keys.
+	events := []types.BaseEvent{
+		poweredOff(3, time.Date(2017, 1, 2, 3, 2, 0, 0, time.UTC)),
+		poweredOff(1, time.Date(2017, 1, 2, 3, 0, 30, 0, time.UTC)),
+		poweredOff(2, time.Date(2017, 1, 2, 3, 1, 30, 0, time.UTC)),
+		poweredOff(4, time.Date(2017, 1, 2, 3, 2, 30, 0, time.UTC)),
+		poweredOff(5, time.Date(2017, 1, 2, 3, 0, 40, 0, time.UTC)),
+	}
+
+	// The events are read up to 03:02 and then up to the end, so the event at
+	// 03:02 is read twice.
+	var reads []time.Time
+	read := func(ctx context.Context, from, to time.Time) ([]types.BaseEvent, error) {
+		reads = append(reads, from)
+
+		var found []types.BaseEvent
+		for _, e := range events {
+			createdTime := e.GetEvent().CreatedTime
+			if !createdTime.Before(from) && !createdTime.After(to) {
+				found = append(found, e)
+			}
+		}
+		return found, nil
+	}
+
+	err := listener.backfillEvents(context.Background(), read, from, to)
+	if err != nil {
+		t.Fatalf("backfillEvents returned error: %v", err)
+	}
+
+	if len(reads) != 2 {
+		t.Errorf("expected the events to be read twice, but they were read starting at %v", reads)
+	}
+
+	expected := map[time.Time]api.Value{
+		time.Date(2017, 1, 2, 3, 1, 0, 0, time.UTC): api.Derive(2),
+		time.Date(2017, 1, 2, 3, 2, 0, 0, time.UTC): api.Derive(4),
+		time.Date(2017, 1, 2, 3, 3, 0, 0, time.UTC): api.Derive(5),
+	}
+	for _, vl := range apiWriter.valueLists {
+		if vl.Host != "backfill-host" || vl.TypeInstance != "power_off_success" {
+			continue
+		}
+
+		value, ok := expected[vl.Time]
+		if !ok {
+			t.Errorf("expected no power_off_success at %s, but got %v", vl.Time, vl.Values[0])
+			continue
+		}
+		if vl.Values[0] != value {
+			t.Errorf("expected power_off_success at %s to be %v, but was %v", vl.Time, value, vl.Values[0])
+		}
+		delete(expected, vl.Time)
+	}
+	for missing := range expected {
+		t.Errorf("expected power_off_success to be written at %s", missing)
+	}
+}
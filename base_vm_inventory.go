@@ -0,0 +1,91 @@
+package collectdvsphere
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// A baseVMInventory is the part of the vSphere inventory that's walked to find
+// base VMs in folders and vApps.
+type baseVMInventory interface {
+	// folderChildren returns the entities directly in a folder.
+	folderChildren(ctx context.Context, folder types.ManagedObjectReference) ([]types.ManagedObjectReference, error)
+
+	// vAppContents returns the VMs and child vApps directly in a vApp.
+	vAppContents(ctx context.Context, vApp types.ManagedObjectReference) (vms, vApps []types.ManagedObjectReference, err error)
+
+	// vmNames returns the names of VMs, in the name property.
+	vmNames(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error)
+
+	// virtualMachines returns the names of VMs and whether they're templates,
+	// in the name and config.template properties.
+	virtualMachines(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error)
+}
+
+// vSphereInventory is a baseVMInventory that reads the inventory of a vSphere
+// API.
+type vSphereInventory struct {
+	client *vim25.Client
+}
+
+func (i vSphereInventory) folderChildren(ctx context.Context, folder types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	var mfolder mo.Folder
+	err := property.DefaultCollector(i.client).RetrieveOne(ctx, folder, []string{"childEntity"}, &mfolder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list children of folder with ID %s", folder)
+	}
+
+	return mfolder.ChildEntity, nil
+}
+
+func (i vSphereInventory) vAppContents(ctx context.Context, vApp types.ManagedObjectReference) ([]types.ManagedObjectReference, []types.ManagedObjectReference, error) {
+	var mvApp mo.VirtualApp
+	err := property.DefaultCollector(i.client).RetrieveOne(ctx, vApp, []string{"vm", "resourcePool"}, &mvApp)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to get VMs in vApp with ID %s", vApp)
+	}
+
+	// The child resource pools of a vApp are usually vApps, but don't have to
+	// be.
+	var vApps []types.ManagedObjectReference
+	for _, childRef := range mvApp.ResourcePool.ResourcePool {
+		if childRef.Type == "VirtualApp" {
+			vApps = append(vApps, childRef)
+		}
+	}
+
+	return mvApp.Vm, vApps, nil
+}
+
+func (i vSphereInventory) vmNames(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+
+	var mvms []mo.VirtualMachine
+	err := property.DefaultCollector(i.client).Retrieve(ctx, vms, []string{"name"}, &mvms)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get names of VMs")
+	}
+
+	return mvms, nil
+}
+
+func (i vSphereInventory) virtualMachines(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+
+	var mvms []mo.VirtualMachine
+	err := property.DefaultCollector(i.client).Retrieve(ctx, vms, []string{"name", "config.template"}, &mvms)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get names of VMs")
+	}
+
+	return mvms, nil
+}
@@ -3,11 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
+	"collectd.org/api"
+	"collectd.org/exec"
+	"collectd.org/format"
 	"collectd.org/network"
 	"github.com/Sirupsen/logrus"
 	raven "github.com/getsentry/raven-go"
@@ -40,67 +48,231 @@ func customVersionPrinter(c *cli.Context) {
 		VersionString, RevisionString, GeneratedString)
 }
 
+var flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "collectd-hostport",
+		Usage:   "the host:port for collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_HOSTPORT", "COLLECTD_HOSTPORT"},
+	},
+	&cli.StringFlag{
+		Name:    "collectd-username",
+		Usage:   "the username for collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_USERNAME", "COLLECTD_USERNAME"},
+	},
+	&cli.StringFlag{
+		Name:    "collectd-password",
+		Usage:   "the password for collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_PASSWORD", "COLLECTD_PASSWORD"},
+	},
+	&cli.StringFlag{
+		Name:    "collectd-auth-file",
+		Usage:   "path to a collectd AuthFile to read the password for collectd from, instead of collectd-password",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_AUTH_FILE", "COLLECTD_AUTH_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "collectd-security-level",
+		Usage:   "the security level for collectd, which is none, sign or encrypt (credentials are only needed for sign and encrypt)",
+		Value:   "encrypt",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_SECURITY_LEVEL", "COLLECTD_SECURITY_LEVEL"},
+	},
+	&cli.BoolFlag{
+		Name:    "collectd-exec",
+		Usage:   "run under the collectd exec plugin, writing PUTVAL commands to stdout instead of connecting to collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_EXEC", "COLLECTD_EXEC"},
+	},
+	&cli.StringFlag{
+		Name:    "vsphere-url",
+		Usage:   "the URL for the vSphere API",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_URL", "VSPHERE_URL"},
+	},
+	&cli.BoolFlag{
+		Name:    "vsphere-insecure",
+		Usage:   "connect to vSphere without verifying TLS certs",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_INSECURE", "VSPHERE_INSECURE"},
+	},
+	&cli.StringFlag{
+		Name:    "vsphere-cluster",
+		Usage:   "path to the vSphere cluster to monitor events on",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_CLUSTER", "VSPHERE_CLUSTER"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "vsphere-clusters",
+		Usage:   "comma-separated paths to the vSphere clusters to monitor events on",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_CLUSTERS", "VSPHERE_CLUSTERS"},
+	},
+	&cli.StringFlag{
+		Name:    "vsphere-base-vm-folder",
+		Usage:   "path to the vSphere folder containing base VMs",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_FOLDER", "VSPHERE_BASE_VM_FOLDER"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "vsphere-base-vm-folders",
+		Usage:   "comma-separated paths to the vSphere folders containing base VMs",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_FOLDERS", "VSPHERE_BASE_VM_FOLDERS"},
+	},
+	&cli.StringFlag{
+		Name:    "vsphere-base-vm-pattern",
+		Usage:   "a regular expression matching the names of base VMs anywhere in the inventory",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_PATTERN", "VSPHERE_BASE_VM_PATTERN"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "vsphere-base-vm-tags",
+		Usage:   "comma-separated names of vSphere tags that base VMs have",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_TAGS", "VSPHERE_BASE_VM_TAGS"},
+	},
+	&cli.DurationFlag{
+		Name:    "vsphere-base-vm-rescan-interval",
+		Usage:   "how often to look for base VMs that were added to or removed from the base VM folders, or 0 to only look on startup",
+		Value:   10 * time.Minute,
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_RESCAN_INTERVAL", "VSPHERE_BASE_VM_RESCAN_INTERVAL"},
+	},
+	&cli.IntFlag{
+		Name:    "vsphere-base-vm-folder-depth",
+		Usage:   "how many levels of sub-folders and vApps of the base VM folders to look for base VMs in, or -1 for no limit",
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_FOLDER_DEPTH", "VSPHERE_BASE_VM_FOLDER_DEPTH"},
+	},
+	&cli.DurationFlag{
+		Name:    "host-removal-grace-period",
+		Usage:   "how long to keep reporting a host after it was removed from the clusters",
+		Value:   10 * time.Minute,
+		EnvVars: []string{"COLLECTD_VSPHERE_HOST_REMOVAL_GRACE_PERIOD", "HOST_REMOVAL_GRACE_PERIOD"},
+	},
+	&cli.DurationFlag{
+		Name:    "vsphere-host-rescan-interval",
+		Usage:   "how often to look for hosts that were added to or removed from the clusters, or 0 to only look on startup",
+		Value:   10 * time.Minute,
+		EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_HOST_RESCAN_INTERVAL", "VSPHERE_HOST_RESCAN_INTERVAL"},
+	},
+	&cli.StringFlag{
+		Name:    "event-checkpoint-file",
+		Usage:   "path to a file to store the last handled vSphere event in, to resume from there after a restart",
+		EnvVars: []string{"COLLECTD_VSPHERE_EVENT_CHECKPOINT_FILE", "EVENT_CHECKPOINT_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "counter-state-file",
+		Usage:   "path to a file to store the counters in, so they continue from where they were after a restart",
+		EnvVars: []string{"COLLECTD_VSPHERE_COUNTER_STATE_FILE", "COUNTER_STATE_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "sentry-dsn",
+		Usage:   "DSN for Sentry integration",
+		EnvVars: []string{"COLLECTD_VSPHERE_SENTRY_DSN", "SENTRY_DSN"},
+	},
+	&cli.StringFlag{
+		Name:    "collectd-plugin-instance",
+		Usage:   "Plugin instance value for collectd metrics to be able to distinguish metrics from this instance of collectd-vsphere from other instances",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_PLUGIN_INSTANCE", "COLLECTD_PLUGIN_INSTANCE"},
+	},
+	&cli.IntFlag{
+		Name:    "collectd-retry-queue-size",
+		Usage:   "the number of value lists to keep to send to collectd again after sending them failed",
+		Value:   10000,
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_RETRY_QUEUE_SIZE", "COLLECTD_RETRY_QUEUE_SIZE"},
+	},
+	&cli.BoolFlag{
+		Name:    "collectd-plugin-instance-location",
+		Usage:   "add the datacenter and cluster of each metric to its collectd plugin instance",
+		EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_PLUGIN_INSTANCE_LOCATION", "COLLECTD_PLUGIN_INSTANCE_LOCATION"},
+	},
+	&cli.DurationFlag{
+		Name:    "interval",
+		Usage:   "how often metrics are written (defaults to 1m, or the interval collectd gives under the exec plugin)",
+		EnvVars: []string{"COLLECTD_VSPHERE_INTERVAL", "INTERVAL"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "family-intervals",
+		Usage:   "comma-separated name=interval pairs to write some metrics at a different interval, such as power_on_success=10s,reconnect=5m",
+		EnvVars: []string{"COLLECTD_VSPHERE_FAMILY_INTERVALS", "FAMILY_INTERVALS"},
+	},
+	&cli.DurationFlag{
+		Name:    "write-timeout",
+		Usage:   "how long to wait for an output to accept the metrics of an interval",
+		Value:   30 * time.Second,
+		EnvVars: []string{"COLLECTD_VSPHERE_WRITE_TIMEOUT", "WRITE_TIMEOUT"},
+	},
+	&cli.StringFlag{
+		Name:    "prometheus-listen",
+		Usage:   "the address to serve Prometheus metrics on at /metrics, such as :9100 (collectd is optional when this is set)",
+		EnvVars: []string{"COLLECTD_VSPHERE_PROMETHEUS_LISTEN", "PROMETHEUS_LISTEN"},
+	},
+	&cli.StringFlag{
+		Name:    "statsd-address",
+		Usage:   "the host:port of a StatsD or DogStatsD agent to send metrics to instead of collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_STATSD_ADDRESS", "STATSD_ADDRESS"},
+	},
+	&cli.StringFlag{
+		Name:    "statsd-prefix",
+		Usage:   "the prefix for the names of metrics sent to StatsD",
+		Value:   "vsphere",
+		EnvVars: []string{"COLLECTD_VSPHERE_STATSD_PREFIX", "STATSD_PREFIX"},
+	},
+	&cli.StringFlag{
+		Name:    "graphite-address",
+		Usage:   "the host:port of a carbon server to send metrics to with the Graphite plaintext protocol instead of collectd",
+		EnvVars: []string{"COLLECTD_VSPHERE_GRAPHITE_ADDRESS", "GRAPHITE_ADDRESS"},
+	},
+	&cli.StringFlag{
+		Name:    "graphite-prefix",
+		Usage:   "the prefix for the paths of metrics sent to Graphite",
+		EnvVars: []string{"COLLECTD_VSPHERE_GRAPHITE_PREFIX", "GRAPHITE_PREFIX"},
+	},
+	&cli.StringFlag{
+		Name:    "graphite-path-template",
+		Usage:   "the template for the paths of metrics sent to Graphite, using {entity_kind}, {entity}, {cluster}, {datacenter}, {plugin_instance}, {type} and {name}",
+		Value:   collectdvsphere.DefaultGraphitePathTemplate,
+		EnvVars: []string{"COLLECTD_VSPHERE_GRAPHITE_PATH_TEMPLATE", "GRAPHITE_PATH_TEMPLATE"},
+	},
+	&cli.StringFlag{
+		Name:    "influxdb-url",
+		Usage:   "the write URL of InfluxDB to send metrics to instead of collectd, such as http://influxdb:8086/write?db=vsphere",
+		EnvVars: []string{"COLLECTD_VSPHERE_INFLUXDB_URL", "INFLUXDB_URL"},
+	},
+	&cli.StringFlag{
+		Name:    "influxdb-token",
+		Usage:   "the API token for InfluxDB 2.x",
+		EnvVars: []string{"COLLECTD_VSPHERE_INFLUXDB_TOKEN", "INFLUXDB_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:    "jsonl-file",
+		Usage:   "path to a file to append every handled vSphere event and the metrics of every interval to as JSON lines",
+		EnvVars: []string{"COLLECTD_VSPHERE_JSONL_FILE", "JSONL_FILE"},
+	},
+	&cli.Int64Flag{
+		Name:    "jsonl-file-max-size",
+		Usage:   "the size in bytes after which the JSON lines file is rotated, or 0 to never rotate it",
+		Value:   100 * 1024 * 1024,
+		EnvVars: []string{"COLLECTD_VSPHERE_JSONL_FILE_MAX_SIZE", "JSONL_FILE_MAX_SIZE"},
+	},
+	&cli.IntFlag{
+		Name:    "jsonl-file-max-backups",
+		Usage:   "the number of rotated JSON lines files to keep",
+		Value:   5,
+		EnvVars: []string{"COLLECTD_VSPHERE_JSONL_FILE_MAX_BACKUPS", "JSONL_FILE_MAX_BACKUPS"},
+	},
+}
+
 func main() {
 	app := &cli.App{
 		Name:    "collectd-vsphere",
 		Usage:   "forward metrics from vSphere events to collectd",
 		Version: VersionString,
 		Action:  mainAction,
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:    "collectd-hostport",
-				Usage:   "the host:port for collectd",
-				EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_HOSTPORT", "COLLECTD_HOSTPORT"},
-			},
-			&cli.StringFlag{
-				Name:    "collectd-username",
-				Usage:   "the username for collectd",
-				EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_USERNAME", "COLLECTD_USERNAME"},
-			},
-			&cli.StringFlag{
-				Name:    "collectd-password",
-				Usage:   "the password for collectd",
-				EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_PASSWORD", "COLLECTD_PASSWORD"},
-			},
-			&cli.StringFlag{
-				Name:    "vsphere-url",
-				Usage:   "the URL for the vSphere API",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_URL", "VSPHERE_URL"},
-			},
-			&cli.BoolFlag{
-				Name:    "vsphere-insecure",
-				Usage:   "connect to vSphere without verifying TLS certs",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_INSECURE", "VSPHERE_INSECURE"},
-			},
-			&cli.StringFlag{
-				Name:    "vsphere-cluster",
-				Usage:   "path to the vSphere cluster to monitor events on",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_CLUSTER", "VSPHERE_CLUSTER"},
-			},
-			&cli.StringSliceFlag{
-				Name:    "vsphere-clusters",
-				Usage:   "comma-separated paths to the vSphere clusters to monitor events on",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_CLUSTERS", "VSPHERE_CLUSTERS"},
-			},
-			&cli.StringFlag{
-				Name:    "vsphere-base-vm-folder",
-				Usage:   "path to the vSphere folder containing base VMs",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_FOLDER", "VSPHERE_BASE_VM_FOLDER"},
-			},
-			&cli.StringSliceFlag{
-				Name:    "vsphere-base-vm-folders",
-				Usage:   "comma-separated paths to the vSphere folders containing base VMs",
-				EnvVars: []string{"COLLECTD_VSPHERE_VSPHERE_BASE_VM_FOLDERS", "VSPHERE_BASE_VM_FOLDERS"},
-			},
-			&cli.StringFlag{
-				Name:    "sentry-dsn",
-				Usage:   "DSN for Sentry integration",
-				EnvVars: []string{"COLLECTD_VSPHERE_SENTRY_DSN", "SENTRY_DSN"},
-			},
-			&cli.StringFlag{
-				Name:    "collectd-plugin-instance",
-				Usage:   "Plugin instance value for collectd metrics to be able to distinguish metrics from this instance of collectd-vsphere from other instances",
-				EnvVars: []string{"COLLECTD_VSPHERE_COLLECTD_PLUGIN_INSTANCE", "COLLECTD_PLUGIN_INSTANCE"},
+		Flags:   flags,
+		Commands: []*cli.Command{
+			{
+				Name:   "backfill",
+				Usage:  "replay the vSphere events in a past time range and send the resulting metrics to collectd",
+				Action: backfillAction,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "the start of the time range to backfill, in RFC 3339 format",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "the end of the time range to backfill, in RFC 3339 format (defaults to now)",
+					},
+				}, flags...),
 			},
 		},
 	}
@@ -109,13 +281,138 @@ func main() {
 }
 
 func mainAction(c *cli.Context) error {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
-	logger := logrus.WithField("pid", os.Getpid())
+	logger := setupLogging()
 	logger.Info("collectd-vsphere starting")
 	defer logger.Info("collectd-vsphere stopping")
 
+	setupSentry(c, logger)
+
+	sinks := newMetricSinks(c, logger)
+
+	var jsonLinesWriter *collectdvsphere.JSONLinesWriter
+	if c.String("jsonl-file") != "" {
+		jsonLinesWriter = collectdvsphere.NewJSONLinesWriter(c.String("jsonl-file"), c.Int64("jsonl-file-max-size"), c.Int("jsonl-file-max-backups"))
+		defer jsonLinesWriter.Close()
+
+		sinks = append(sinks, metricSink{"jsonl", jsonLinesWriter})
+	}
+
+	statsCollector := newStatsCollector(c, nil, logger)
+	for _, sink := range sinks {
+		statsCollector.AddSink(sink.name, sink.writer)
+	}
+
+	if c.String("counter-state-file") != "" {
+		err := statsCollector.PersistCounters(c.String("counter-state-file"))
+		if err != nil {
+			raven.CaptureErrorAndWait(err, nil)
+			logger.WithField("err", err).Fatal("couldn't restore counters")
+		}
+		defer func() {
+			err := statsCollector.SaveCounters()
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't save counters")
+			}
+		}()
+	}
+
+	// Stop the event listener on SIGINT or SIGTERM, so that the counters
+	// are saved before exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.WithField("signal", sig).Info("stopping")
+		cancel()
+	}()
+	eventListener := newEventListener(c, statsCollector, logger)
+	if jsonLinesWriter != nil {
+		eventListener.SetEventRecorder(jsonLinesWriter)
+	}
+
+	if c.String("prometheus-listen") != "" {
+		go servePrometheus(c.String("prometheus-listen"), statsCollector, logger)
+	}
+
+	panicErr, _ := raven.CapturePanicAndWait(func() {
+		err := eventListener.Start(ctx)
+		if err != nil {
+			raven.CaptureErrorAndWait(err, nil)
+			logger.WithField("err", err).Fatal("event listener errored")
+		}
+	}, nil)
+	if panicErr != nil {
+		logger.WithField("err", panicErr).Fatal("eventListener paniced, exiting")
+	}
+
+	return nil
+}
+
+func backfillAction(c *cli.Context) error {
+	ctx := context.Background()
+
+	logger := setupLogging()
+	logger.Info("collectd-vsphere backfill starting")
+	defer logger.Info("collectd-vsphere backfill stopping")
+
+	setupSentry(c, logger)
+
+	// The other outputs would take the backfilled metrics for current ones.
+	for _, name := range []string{"statsd-address", "graphite-address", "influxdb-url", "jsonl-file", "prometheus-listen"} {
+		if c.String(name) != "" {
+			logger.WithField("flag", name).Fatal("backfill only sends metrics to collectd, so the flag can't be set")
+		}
+	}
+	if c.Bool("collectd-exec") {
+		logger.Fatal("backfill sends metrics to collectd over the network, so collectd-exec can't be set")
+	}
+
+	if c.String("from") == "" {
+		logger.Fatal("from must be set")
+	}
+	from, err := time.Parse(time.RFC3339, c.String("from"))
+	if err != nil {
+		logger.WithField("err", err).Fatal("couldn't parse from")
+	}
+	to := time.Now()
+	if c.String("to") != "" {
+		to, err = time.Parse(time.RFC3339, c.String("to"))
+		if err != nil {
+			logger.WithField("err", err).Fatal("couldn't parse to")
+		}
+	}
+
+	statWriter := dialCollectd(c, logger)
+	interval, pluginInstance := statsCollectorSettings(c, logger)
+	statsCollector := collectdvsphere.NewBackfillStatsCollector(newCollectdWriter(c, statWriter, logger), interval, logger, pluginInstance)
+	eventListener := newEventListener(c, statsCollector, logger)
+
+	err = eventListener.Backfill(ctx, from, to)
+	if err != nil {
+		raven.CaptureErrorAndWait(err, nil)
+		logger.WithField("err", err).Fatal("backfill failed")
+	}
+
+	// The collectd client only sends metrics once its buffer is full, so the
+	// rest has to be flushed before exiting.
+	err = statWriter.Close()
+	if err != nil {
+		raven.CaptureErrorAndWait(err, nil)
+		logger.WithField("err", err).Fatal("couldn't flush metrics to collectd")
+	}
+
+	return nil
+}
+
+func setupLogging() logrus.FieldLogger {
+	logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+	return logrus.WithField("pid", os.Getpid())
+}
+
+func setupSentry(c *cli.Context, logger logrus.FieldLogger) {
 	if c.String("sentry-dsn") != "" {
 		err := raven.SetDSN(c.String("sentry-dsn"))
 		if err != nil {
@@ -123,27 +420,183 @@ func mainAction(c *cli.Context) error {
 		}
 		raven.SetRelease(VersionString)
 	}
+}
+
+// A metricSink is a MetricWriter to send metrics to, with a name that's used
+// in logs and in the metrics about the sink.
+type metricSink struct {
+	name   string
+	writer collectdvsphere.MetricWriter
+}
+
+// newMetricSinks returns every MetricWriter to send metrics to. It's empty if
+// metrics are only exposed to Prometheus.
+func newMetricSinks(c *cli.Context, logger logrus.FieldLogger) []metricSink {
+	var sinks []metricSink
 
+	if c.Bool("collectd-exec") {
+		sinks = append(sinks, metricSink{"collectd-exec", newCollectdWriter(c, format.NewPutval(os.Stdout), logger)})
+	}
+	if c.String("statsd-address") != "" {
+		logger.Info("connecting to statsd")
+		statWriter, err := collectdvsphere.NewStatsDWriter(c.String("statsd-address"), c.String("statsd-prefix"))
+		if err != nil {
+			raven.CaptureErrorAndWait(err, nil)
+			logger.WithField("err", err).Fatal("couldn't connect to statsd")
+		}
+		sinks = append(sinks, metricSink{"statsd", statWriter})
+	}
+	if c.String("graphite-address") != "" {
+		sinks = append(sinks, metricSink{"graphite", collectdvsphere.NewGraphiteWriter(c.String("graphite-address"), c.String("graphite-prefix"), c.String("graphite-path-template"))})
+	}
+	if c.String("influxdb-url") != "" {
+		sinks = append(sinks, metricSink{"influxdb", collectdvsphere.NewInfluxDBWriter(c.String("influxdb-url"), c.String("influxdb-token"))})
+	}
+
+	// collectd is the default output, unless metrics are sent somewhere else
+	// or only exposed to Prometheus.
+	if c.String("collectd-hostport") != "" || (len(sinks) == 0 && c.String("prometheus-listen") == "" && c.String("jsonl-file") == "") {
+		sinks = append(sinks, metricSink{"collectd", newCollectdWriter(c, dialCollectd(c, logger), logger)})
+	}
+
+	return sinks
+}
+
+// newCollectdWriter returns a MetricWriter that writes value lists to the
+// given api.Writer, with the location of each metric in its plugin instance if
+// that's enabled, and retries the value lists it fails to write.
+func newCollectdWriter(c *cli.Context, writer api.Writer, logger logrus.FieldLogger) collectdvsphere.MetricWriter {
+	if c.Int("collectd-retry-queue-size") < 0 {
+		logger.Fatal("collectd-retry-queue-size must not be negative")
+	}
+
+	var collectdWriter *collectdvsphere.CollectdWriter
+	if c.Bool("collectd-plugin-instance-location") {
+		collectdWriter = collectdvsphere.NewCollectdLocationWriter(writer)
+	} else {
+		collectdWriter = collectdvsphere.NewCollectdWriter(writer)
+	}
+	collectdWriter.SetRetryQueueSize(c.Int("collectd-retry-queue-size"))
+
+	return collectdWriter
+}
+
+func dialCollectd(c *cli.Context, logger logrus.FieldLogger) *network.Client {
 	logger.Info("connecting to collectd")
 
-	if c.String("collectd-hostport") == "" || c.String("collectd-username") == "" || c.String("collectd-password") == "" {
-		logger.Fatal("collectd-hostport, collectd-username and collectd-password flags must be set")
+	if c.String("collectd-hostport") == "" {
+		logger.Fatal("collectd-hostport must be set")
 	}
-	statWriter, err := network.Dial(c.String("collectd-hostport"), network.ClientOptions{
-		SecurityLevel: network.Encrypt,
-		Username:      c.String("collectd-username"),
-		Password:      c.String("collectd-password"),
-	})
+
+	options := network.ClientOptions{
+		Username: c.String("collectd-username"),
+		Password: c.String("collectd-password"),
+	}
+	switch strings.ToLower(c.String("collectd-security-level")) {
+	case "none":
+		options.SecurityLevel = network.None
+	case "sign":
+		options.SecurityLevel = network.Sign
+	case "encrypt":
+		options.SecurityLevel = network.Encrypt
+	default:
+		logger.WithField("security_level", c.String("collectd-security-level")).Fatal("collectd-security-level must be none, sign or encrypt")
+	}
+
+	if c.String("collectd-auth-file") != "" {
+		if c.String("collectd-password") != "" {
+			logger.Fatal("only one of collectd-password and collectd-auth-file should be set")
+		}
+
+		var err error
+		options.Username, options.Password, err = collectdvsphere.ReadCollectdAuthFile(c.String("collectd-auth-file"), options.Username)
+		if err != nil {
+			raven.CaptureErrorAndWait(err, nil)
+			logger.WithField("err", err).Fatal("couldn't read collectd auth file")
+		}
+	}
+
+	if options.SecurityLevel != network.None && (options.Username == "" || options.Password == "") {
+		logger.Fatal("collectd-username and collectd-password or collectd-auth-file must be set unless collectd-security-level is none")
+	}
+
+	statWriter, err := network.Dial(c.String("collectd-hostport"), options)
 	if err != nil {
 		raven.CaptureErrorAndWait(err, nil)
 		logger.WithField("err", err).Fatal("couldn't connect to collectd")
 	}
 
-	if c.String("collectd-plugin-instance") == "" {
+	return statWriter
+}
+
+func servePrometheus(addr string, statsCollector *collectdvsphere.StatsCollector, logger logrus.FieldLogger) {
+	logger.WithField("addr", addr).Info("serving prometheus metrics")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collectdvsphere.NewPrometheusExporter(statsCollector))
+
+	err := http.ListenAndServe(addr, mux)
+	raven.CaptureErrorAndWait(err, nil)
+	logger.WithField("err", err).Fatal("prometheus listener errored")
+}
+
+func newStatsCollector(c *cli.Context, statWriter collectdvsphere.MetricWriter, logger logrus.FieldLogger) *collectdvsphere.StatsCollector {
+	interval, pluginInstance := statsCollectorSettings(c, logger)
+
+	if c.Duration("write-timeout") <= 0 {
+		logger.Fatal("write-timeout must be positive")
+	}
+
+	statsCollector := collectdvsphere.NewMetricStatsCollector(statWriter, interval, logger, pluginInstance)
+	statsCollector.SetWriteTimeout(c.Duration("write-timeout"))
+
+	for _, familyInterval := range c.StringSlice("family-intervals") {
+		parts := strings.SplitN(familyInterval, "=", 2)
+		if len(parts) != 2 {
+			logger.WithField("family_interval", familyInterval).Fatal("family-intervals must be name=interval pairs")
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil {
+			logger.WithField("err", err).Fatal("couldn't parse family interval")
+		}
+		err = statsCollector.SetFamilyInterval(parts[0], duration)
+		if err != nil {
+			logger.WithField("err", err).Fatal("couldn't set family interval")
+		}
+	}
+
+	return statsCollector
+}
+
+// statsCollectorSettings returns the interval and collectd plugin instance of
+// the StatsCollector.
+func statsCollectorSettings(c *cli.Context, logger logrus.FieldLogger) (time.Duration, string) {
+	interval := time.Minute
+	pluginInstance := c.String("collectd-plugin-instance")
+
+	// Under the exec plugin, metrics are written at the interval collectd
+	// runs at, and the plugin instance defaults to collectd's hostname.
+	if c.Bool("collectd-exec") {
+		interval = exec.Interval()
+		if pluginInstance == "" {
+			pluginInstance = exec.Hostname()
+		}
+	}
+	if c.IsSet("interval") {
+		interval = c.Duration("interval")
+	}
+
+	if pluginInstance == "" {
 		logger.Fatal("collectd-plugin-instance must be set")
 	}
-	statsCollector := collectdvsphere.NewStatsCollector(statWriter, time.Minute, logger, c.String("collectd-plugin-instance"))
+	if interval <= 0 {
+		logger.Fatal("interval must be positive")
+	}
+
+	return interval, pluginInstance
+}
 
+func newEventListener(c *cli.Context, statsCollector *collectdvsphere.StatsCollector, logger logrus.FieldLogger) *collectdvsphere.VSphereEventListener {
 	var clusterPaths []string
 	if c.String("vsphere-cluster") != "" && len(c.StringSlice("vsphere-clusters")) > 0 {
 		logger.Fatal("only one of vsphere-cluster and vsphere-clusters should be set")
@@ -162,9 +615,18 @@ func mainAction(c *cli.Context) error {
 		baseVMPaths = []string{c.String("vsphere-base-vm-folder")}
 	} else if len(c.StringSlice("vsphere-base-vm-folders")) > 0 {
 		baseVMPaths = c.StringSlice("vsphere-base-vm-folders")
-	} else {
+	} else if c.String("vsphere-base-vm-pattern") == "" && len(c.StringSlice("vsphere-base-vm-tags")) == 0 {
 		// This is just a warning to remain compatible with v1.0.0
-		logger.Warn("vsphere-base-vm-folder and vsphere-base-vm-folders aren't set")
+		logger.Warn("none of vsphere-base-vm-folder, vsphere-base-vm-folders, vsphere-base-vm-pattern and vsphere-base-vm-tags are set")
+	}
+
+	var baseVMNamePattern *regexp.Regexp
+	if c.String("vsphere-base-vm-pattern") != "" {
+		pattern, err := regexp.Compile(c.String("vsphere-base-vm-pattern"))
+		if err != nil {
+			logger.WithField("err", err).Fatal("couldn't parse vsphere-base-vm-pattern")
+		}
+		baseVMNamePattern = pattern
 	}
 
 	if c.String("vsphere-url") == "" {
@@ -176,23 +638,17 @@ func mainAction(c *cli.Context) error {
 		logger.WithField("err", err).Fatal("couldn't parse vsphere url")
 	}
 
-	eventListener := collectdvsphere.NewVSphereEventListener(collectdvsphere.VSphereConfig{
-		URL:          u,
-		Insecure:     c.Bool("vsphere-insecure"),
-		ClusterPaths: clusterPaths,
-		BaseVMPaths:  baseVMPaths,
+	return collectdvsphere.NewVSphereEventListener(collectdvsphere.VSphereConfig{
+		URL:                    u,
+		Insecure:               c.Bool("vsphere-insecure"),
+		ClusterPaths:           clusterPaths,
+		BaseVMPaths:            baseVMPaths,
+		BaseVMNamePattern:      baseVMNamePattern,
+		BaseVMTags:             c.StringSlice("vsphere-base-vm-tags"),
+		CheckpointPath:         c.String("event-checkpoint-file"),
+		HostRemovalGracePeriod: c.Duration("host-removal-grace-period"),
+		HostRescanInterval:     c.Duration("vsphere-host-rescan-interval"),
+		BaseVMRescanInterval:   c.Duration("vsphere-base-vm-rescan-interval"),
+		BaseVMFolderDepth:      c.Int("vsphere-base-vm-folder-depth"),
 	}, statsCollector, logger.WithField("component", "vsphere-event-listener"))
-
-	panicErr, _ := raven.CapturePanicAndWait(func() {
-		err := eventListener.Start(ctx)
-		if err != nil {
-			raven.CaptureErrorAndWait(err, nil)
-			logger.WithField("err", err).Fatal("event listener errored")
-		}
-	}, nil)
-	if panicErr != nil {
-		logger.WithField("err", panicErr).Fatal("eventListener paniced, exiting")
-	}
-
-	return nil
 }
@@ -0,0 +1,62 @@
+package collectdvsphere
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReadCollectdAuthFile reads a file in the format of the AuthFile option of
+// collectd's network plugin, and returns the password for the given username.
+// If username is empty and the file only has one user in it, that user's name
+// and password are returned.
+//
+// Each line of the file is a username followed by a colon, any number of
+// spaces and the password. Empty lines and lines starting with # are ignored.
+func ReadCollectdAuthFile(path, username string) (user, password string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to open collectd auth file %s", path)
+	}
+	defer file.Close()
+
+	passwords := make(map[string]string)
+	var users []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", "", errors.Errorf("invalid line in collectd auth file %s", path)
+		}
+
+		if _, ok := passwords[parts[0]]; !ok {
+			users = append(users, parts[0])
+		}
+		passwords[parts[0]] = strings.TrimLeft(parts[1], " \t")
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", errors.Wrapf(err, "failed to read collectd auth file %s", path)
+	}
+
+	if username == "" {
+		if len(users) != 1 {
+			return "", "", errors.Errorf("collectd auth file %s has %d users, so a username must be given", path, len(users))
+		}
+		username = users[0]
+	}
+
+	password, ok := passwords[username]
+	if !ok {
+		return "", "", errors.Errorf("user %s not found in collectd auth file %s", username, path)
+	}
+
+	return username, password, nil
+}
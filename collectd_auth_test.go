@@ -0,0 +1,48 @@
+package collectdvsphere
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCollectdAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "auth_file")
+	err = ioutil.WriteFile(path, []byte("# collectd users\n\nalice: secret one\nbob:other\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write auth file: %v", err)
+	}
+
+	user, password, err := ReadCollectdAuthFile(path, "alice")
+	if err != nil {
+		t.Fatalf("ReadCollectdAuthFile returned error: %v", err)
+	}
+	if user != "alice" || password != "secret one" {
+		t.Errorf("expected alice with password %q, but got %s with password %q", "secret one", user, password)
+	}
+
+	_, password, err = ReadCollectdAuthFile(path, "bob")
+	if err != nil {
+		t.Fatalf("ReadCollectdAuthFile returned error: %v", err)
+	}
+	if password != "other" {
+		t.Errorf("expected bob's password to be %q, but was %q", "other", password)
+	}
+
+	_, _, err = ReadCollectdAuthFile(path, "")
+	if err == nil {
+		t.Error("expected an error when not giving a username for a file with two users")
+	}
+
+	_, _, err = ReadCollectdAuthFile(path, "carol")
+	if err == nil {
+		t.Error("expected an error for a user that isn't in the file")
+	}
+}
@@ -0,0 +1,183 @@
+package collectdvsphere
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"collectd.org/api"
+)
+
+// counterState is what's stored in the counter state file: the value of every
+// counter, keyed by the name of its metric family and then by entity, and the
+// event checkpoint the counters include the events up to, if the event
+// listener keeps it there.
+type counterState struct {
+	Counters   map[string]map[string]int64 `json:"counters"`
+	Checkpoint *eventCheckpointState       `json:"checkpoint,omitempty"`
+}
+
+// PersistCounters restores the counters from the file at the given path, if it
+// exists, and saves them to that file after every write from then on, so that
+// the counters continue from where they were after a restart instead of
+// starting at zero again. It should be called before any stats are sent to the
+// StatsCollector. Call SaveCounters when shutting down to save the latest
+// values.
+func (c *StatsCollector) PersistCounters(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read counter state file %s", path)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.counterStatePath = path
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	var state counterState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse counter state file %s", path)
+	}
+
+	var baseline []Metric
+	for name, values := range state.Counters {
+		family := c.registry.family(name, familyCounter)
+		if family == nil {
+			c.logger.WithField("name", name).Warn("ignoring unknown counter in counter state file")
+			continue
+		}
+
+		for entity, value := range values {
+			c.registry.add(name, entity, value)
+			baseline = append(baseline, c.makeMetric(family, entity, "operations", name, time.Time{}, api.Derive(value)))
+		}
+	}
+
+	c.restoredCheckpoint = state.Checkpoint
+
+	// Sinks that write how much counters changed would otherwise write the
+	// restored values as changes.
+	c.counterBaseline = baseline
+	for _, sink := range c.sinks {
+		if baselineWriter, ok := sink.writer.(counterBaselineWriter); ok {
+			baselineWriter.setCounterBaseline(baseline)
+		}
+	}
+
+	return nil
+}
+
+// SaveCounters writes the counters to the file given to PersistCounters. It
+// does nothing if PersistCounters wasn't called.
+func (c *StatsCollector) SaveCounters() error {
+	// The state is copied and written in one go, so that a save that copied
+	// the state earlier can't overwrite the file with it afterwards.
+	c.counterStateMutex.Lock()
+	defer c.counterStateMutex.Unlock()
+
+	state, path := c.counterState()
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode counter state")
+	}
+
+	// Write to a temporary file first, so that a crash while writing doesn't
+	// leave a truncated state file behind.
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write counter state file %s", tmpPath)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to move counter state file into place at %s", path)
+	}
+
+	return nil
+}
+
+// counterState returns a copy of the counters and the event checkpoint, and
+// the path of the counter state file, which is empty if the counters aren't
+// persisted.
+func (c *StatsCollector) counterState() (counterState, string) {
+	// Events aren't counted while the state is copied, so that the counters
+	// and the event checkpoint agree.
+	c.eventMutex.Lock()
+	defer c.eventMutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.counterStatePath == "" {
+		return counterState{}, ""
+	}
+
+	state := counterState{
+		Counters:   make(map[string]map[string]int64),
+		Checkpoint: c.restoredCheckpoint,
+	}
+	if c.eventCheckpoint != nil {
+		checkpoint := c.eventCheckpoint.state()
+		state.Checkpoint = &checkpoint
+	}
+	for _, family := range c.registry.families {
+		if family.kind != familyCounter {
+			continue
+		}
+
+		values := make(map[string]int64, len(family.counters))
+		for entity, value := range family.counters {
+			values[entity] = value
+		}
+		state.Counters[family.name] = values
+	}
+
+	return state, c.counterStatePath
+}
+
+// persistsCounters returns whether the counters are saved to a counter state
+// file.
+func (c *StatsCollector) persistsCounters() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.counterStatePath != ""
+}
+
+// restoredEventCheckpoint returns the event checkpoint that was restored from
+// the counter state file, or nil if there wasn't one.
+func (c *StatsCollector) restoredEventCheckpoint() *eventCheckpointState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.restoredCheckpoint
+}
+
+// saveEventCheckpoint saves the given event checkpoint along with the counters
+// from then on. The checkpoint must only be changed in functions given to
+// countEvent.
+func (c *StatsCollector) saveEventCheckpoint(checkpoint *eventCheckpoint) {
+	c.eventMutex.Lock()
+	defer c.eventMutex.Unlock()
+
+	c.eventCheckpoint = checkpoint
+}
+
+// countEvent calls count, which counts an event, so that the counters are
+// never saved with only some of what an event changed.
+func (c *StatsCollector) countEvent(count func()) {
+	c.eventMutex.Lock()
+	defer c.eventMutex.Unlock()
+
+	count()
+}
@@ -0,0 +1,238 @@
+package collectdvsphere
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+
+	"collectd.org/api"
+)
+
+func TestStatsCollectorPersistCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "counters.json")
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = collector.PersistCounters(path)
+	if err != nil {
+		t.Fatalf("failed to restore missing counter state: %v", err)
+	}
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.MarkCloneFailure("no-image")
+	collector.ObserveCloneDuration("no-image", time.Second)
+
+	err = collector.SaveCounters()
+	if err != nil {
+		t.Fatalf("failed to save counters: %v", err)
+	}
+
+	restored := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = restored.PersistCounters(path)
+	if err != nil {
+		t.Fatalf("failed to restore counters: %v", err)
+	}
+	restored.MarkPowerOnSuccess("on-yes-host")
+
+	expected := map[string]int64{
+		"on-yes-host/power_on_success": 3,
+		"on-yes-host/power_on_failure": 0,
+		"no-image/clone_failure":       1,
+		"no-image/clone_success":       0,
+	}
+	for _, metric := range restored.Metrics() {
+		if value, ok := expected[metric.Entity+"/"+metric.Name]; ok {
+			if metric.Value != api.Derive(value) {
+				t.Errorf("expected %s of %s to be %d, but was %v", metric.Name, metric.Entity, value, metric.Value)
+			}
+			delete(expected, metric.Entity+"/"+metric.Name)
+		}
+	}
+	for missing := range expected {
+		t.Errorf("expected %s to be restored", missing)
+	}
+}
+
+func TestStatsCollectorPersistCountersStatsD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "counters.json")
+	err = ioutil.WriteFile(path, []byte(`{"counters": {"power_on_success": {"on-yes-host": 100000}}}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write counter state file: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	writer, err := NewStatsDWriter(conn.LocalAddr().String(), "vsphere")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(writer, time.Minute, nullLogger, "foo-instance")
+	err = collector.PersistCounters(path)
+	if err != nil {
+		t.Fatalf("failed to restore counters: %v", err)
+	}
+	collector.setLocation(EntityHost, "on-yes-host", "cluster-1", "")
+	collector.MarkPowerOnSuccess("on-yes-host")
+
+	err = collector.writeAt(time.Now())
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
+
+	buf := make([]byte, statsDMaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+
+	// Only the power-on since the restart is sent, not the restored total.
+	expected := "vsphere.power_on_success:1|c|#host:on-yes-host,cluster:cluster-1,plugin_instance:foo-instance"
+	if packet := string(buf[:n]); packet != expected {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+}
+
+func TestStatsCollectorSaveRestoredCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "counters.json")
+	err = ioutil.WriteFile(path, []byte(`{"counters":{},"checkpoint":{"last_key":5,"last_time":"2017-01-02T03:04:05Z"}}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write counter state file: %v", err)
+	}
+
+	nullLogger := newNullLogger()
+
+	// The counters can be saved before the event listener has taken over the
+	// restored checkpoint, which mustn't lose it.
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = collector.PersistCounters(path)
+	if err != nil {
+		t.Fatalf("failed to restore counters: %v", err)
+	}
+	err = collector.SaveCounters()
+	if err != nil {
+		t.Fatalf("failed to save counters: %v", err)
+	}
+
+	restored := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = restored.PersistCounters(path)
+	if err != nil {
+		t.Fatalf("failed to restore counters: %v", err)
+	}
+
+	checkpoint := restored.restoredEventCheckpoint()
+	if checkpoint == nil || checkpoint.LastKey != 5 {
+		t.Errorf("expected the checkpoint with last key 5 to be kept, but got %+v", checkpoint)
+	}
+}
+
+func TestVSphereEventListenerCheckpointWithCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	counterPath := filepath.Join(dir, "counters.json")
+	config := VSphereConfig{CheckpointPath: filepath.Join(dir, "checkpoint.json")}
+
+	nullLogger := newNullLogger()
+
+	host := hostArg("checkpoint-host")
+	poweredOff := func(key int32) types.BaseEvent {
+		e := &types.VmPoweredOffEvent{}
+		e.Key = key
+		e.CreatedTime = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+		e.Host = &host
+		return e
+	}
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = collector.PersistCounters(counterPath)
+	if err != nil {
+		t.Fatalf("failed to restore missing counter state: %v", err)
+	}
+	listener := NewVSphereEventListener(config, collector, nullLogger)
+	err = listener.loadCheckpoint()
+	if err != nil {
+		t.Fatalf("failed to load missing checkpoint: %v", err)
+	}
+
+	err = listener.handleEvents(context.Background(), []types.BaseEvent{poweredOff(1), poweredOff(2)}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+	err = collector.SaveCounters()
+	if err != nil {
+		t.Fatalf("failed to save counters: %v", err)
+	}
+
+	// Events that are handled after the counters are saved, but before a
+	// crash, are counted again after the restart.
+	err = listener.handleEvents(context.Background(), []types.BaseEvent{poweredOff(3)}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	if _, err := os.Stat(config.CheckpointPath); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to only be saved in the counter state file, but stat of checkpoint file returned %v", err)
+	}
+
+	restored := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	err = restored.PersistCounters(counterPath)
+	if err != nil {
+		t.Fatalf("failed to restore counters: %v", err)
+	}
+	restoredListener := NewVSphereEventListener(config, restored, nullLogger)
+	err = restoredListener.loadCheckpoint()
+	if err != nil {
+		t.Fatalf("failed to restore checkpoint: %v", err)
+	}
+
+	err = restoredListener.handleEvents(context.Background(), []types.BaseEvent{poweredOff(2), poweredOff(3)}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	for _, metric := range restored.Metrics() {
+		if metric.Entity == "checkpoint-host" && metric.Name == "power_off_success" {
+			if metric.Value != api.Derive(3) {
+				t.Errorf("expected power_off_success to be 3, but was %v", metric.Value)
+			}
+			return
+		}
+	}
+	t.Error("expected power_off_success of checkpoint-host to be restored")
+}
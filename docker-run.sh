@@ -1,10 +1,19 @@
 #!/bin/bash
 
 main() {
+  if collectd_exec; then
+    # collectd runs collectd-vsphere itself through the exec plugin.
+    exec /opt/collectd/sbin/collectd -f
+  fi
+
   /opt/collectd/sbin/collectdmon -c /opt/collectd/sbin/collectd
   ./collectd-vsphere
 }
 
+collectd_exec() {
+  [[ "${COLLECTD_VSPHERE_COLLECTD_EXEC:-${COLLECTD_EXEC}}" == true ]]
+}
+
 write_collectd_config() {
   local conf=/opt/collectd/etc/collectd.conf
   cat <<EOF >$conf
@@ -55,6 +64,18 @@ Include "/opt/collectd/etc/collectd.conf.d/librato.conf"
 LoadPlugin snmp
 Include "/opt/collectd/etc/collectd.conf.d/snmp.conf"
 
+EOF
+
+  if collectd_exec; then
+    # The exec plugin doesn't run programs as root.
+    cat <<EOF >>$conf
+LoadPlugin exec
+<Plugin exec>
+  Exec "nobody" "$(pwd)/collectd-vsphere"
+</Plugin>
+EOF
+  else
+    cat <<EOF >>$conf
 LoadPlugin network
 <Plugin "network">
   <Listen "127.0.0.1" "1785">
@@ -63,6 +84,7 @@ LoadPlugin network
   </Listen>
 </Plugin>
 EOF
+  fi
 
   conf=/opt/collectd/etc/collectd.conf.d/librato.conf
   host=$(hostname)
@@ -113,8 +135,10 @@ EOF
 </Plugin>
 EOF
 
-  conf=/opt/collectd/etc/collectd-network-auth
-  echo "$COLLECTD_VSPHERE_COLLECTD_USERNAME: $COLLECTD_VSPHERE_COLLECTD_PASSWORD" >$conf
+  if ! collectd_exec; then
+    conf=/opt/collectd/etc/collectd-network-auth
+    echo "$COLLECTD_VSPHERE_COLLECTD_USERNAME: $COLLECTD_VSPHERE_COLLECTD_PASSWORD" >$conf
+  fi
 }
 
 write_collectd_config
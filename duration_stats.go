@@ -0,0 +1,76 @@
+package collectdvsphere
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// durationStats collects duration samples over an interval and summarizes
+// them.
+type durationStats struct {
+	samples []time.Duration
+
+	// The summary of the samples in the last complete interval.
+	lastInterval durationSummary
+}
+
+// A durationSummary describes the distribution of a set of durations.
+type durationSummary struct {
+	count int
+	min   time.Duration
+	avg   time.Duration
+	max   time.Duration
+	p50   time.Duration
+	p95   time.Duration
+	p99   time.Duration
+}
+
+func (s *durationStats) add(d time.Duration) {
+	s.samples = append(s.samples, d)
+}
+
+// summarize returns a summary of the samples added since the last call to
+// summarize, and then discards those samples.
+func (s *durationStats) summarize() durationSummary {
+	samples := s.samples
+	s.samples = nil
+
+	if len(samples) == 0 {
+		return durationSummary{}
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+
+	return durationSummary{
+		count: len(samples),
+		min:   samples[0],
+		avg:   total / time.Duration(len(samples)),
+		max:   samples[len(samples)-1],
+		p50:   percentile(samples, 0.50),
+		p95:   percentile(samples, 0.95),
+		p99:   percentile(samples, 0.99),
+	}
+}
+
+// summarizeInterval ends the current interval, and stores the summary of its
+// samples in lastInterval.
+func (s *durationStats) summarizeInterval() {
+	s.lastInterval = s.summarize()
+}
+
+// percentile returns the p-th percentile of the sorted samples using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
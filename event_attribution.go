@@ -0,0 +1,177 @@
+package collectdvsphere
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// unattributedEntity is the host or base VM name that events are counted under
+// when it's not possible to tell which host or base VM they belong to.
+const unattributedEntity = "unattributed"
+
+// hostName returns the name of the host an event happened on. If the event
+// doesn't include the name of the host, it's looked up using the reference to
+// the host on the event, or failing that, if the event is live, the host that
+// the VM on the event is running on. For replayed and backfilled events, the
+// VM could have moved to another host since.
+func (l *VSphereEventListener) hostName(ctx context.Context, baseEvent types.BaseEvent, live bool) string {
+	e := baseEvent.GetEvent()
+
+	if e.Host != nil {
+		if name := l.entityName(ctx, e.Host.Name, e.Host.Host); name != "" {
+			return name
+		}
+	}
+
+	if e.Vm != nil && live {
+		if name := l.vmHostName(ctx, e.Vm.Vm); name != "" {
+			return name
+		}
+	}
+
+	l.logUnattributed(baseEvent, "host")
+	return unattributedEntity
+}
+
+// hostArgName returns the name of a host on an event that refers to more than
+// one host, such as the source host of a migration.
+func (l *VSphereEventListener) hostArgName(ctx context.Context, baseEvent types.BaseEvent, arg types.HostEventArgument) string {
+	if name := l.entityName(ctx, arg.Name, arg.Host); name != "" {
+		return name
+	}
+
+	l.logUnattributed(baseEvent, "host")
+	return unattributedEntity
+}
+
+// vmArgName returns the name of a VM on an event, such as the base VM of a
+// clone.
+func (l *VSphereEventListener) vmArgName(ctx context.Context, baseEvent types.BaseEvent, arg *types.VmEventArgument) string {
+	if arg != nil {
+		if name := l.entityName(ctx, arg.Name, arg.Vm); name != "" {
+			return name
+		}
+	}
+
+	l.logUnattributed(baseEvent, "vm")
+	return unattributedEntity
+}
+
+// entityName returns name if it's set, and otherwise looks up the name of the
+// managed entity with the given reference. An empty string is returned if the
+// name can't be found.
+func (l *VSphereEventListener) entityName(ctx context.Context, name string, ref types.ManagedObjectReference) string {
+	if name != "" {
+		return name
+	}
+	if ref.Value == "" || l.client == nil {
+		return ""
+	}
+
+	l.entityNamesMutex.Lock()
+	name, ok := l.entityNames[ref]
+	l.entityNamesMutex.Unlock()
+	if ok {
+		return name
+	}
+
+	var entity mo.ManagedEntity
+	err := property.DefaultCollector(l.client.Client).RetrieveOne(ctx, ref, []string{"name"}, &entity)
+	if err != nil {
+		l.logger.WithFields(logrus.Fields{
+			"err": err,
+			"ref": ref.String(),
+		}).Warn("failed to look up entity name")
+		return ""
+	}
+
+	l.entityNamesMutex.Lock()
+	l.entityNames[ref] = entity.Name
+	l.entityNamesMutex.Unlock()
+	return entity.Name
+}
+
+// vmHostName returns the name of the host that a VM is currently running on.
+// An empty string is returned if the host can't be found.
+func (l *VSphereEventListener) vmHostName(ctx context.Context, ref types.ManagedObjectReference) string {
+	if ref.Value == "" || l.client == nil {
+		return ""
+	}
+
+	var vm mo.VirtualMachine
+	err := property.DefaultCollector(l.client.Client).RetrieveOne(ctx, ref, []string{"runtime.host"}, &vm)
+	if err != nil {
+		l.logger.WithFields(logrus.Fields{
+			"err": err,
+			"ref": ref.String(),
+		}).Warn("failed to look up host of vm")
+		return ""
+	}
+	if vm.Runtime.Host == nil {
+		return ""
+	}
+
+	return l.entityName(ctx, "", *vm.Runtime.Host)
+}
+
+func (l *VSphereEventListener) logUnattributed(baseEvent types.BaseEvent, entityType string) {
+	l.logger.WithFields(logrus.Fields{
+		"event_key":   baseEvent.GetEvent().Key,
+		"event_type":  fmt.Sprintf("%T", baseEvent),
+		"entity_type": entityType,
+	}).Warn("couldn't attribute event, counting it as unattributed")
+}
+
+// eventHostName returns the name of the host an event happened on like
+// hostName, and records the compute cluster and datacenter the event says the
+// host is in.
+func (l *VSphereEventListener) eventHostName(ctx context.Context, baseEvent types.BaseEvent, live bool) string {
+	name := l.hostName(ctx, baseEvent, live)
+
+	e := baseEvent.GetEvent()
+	var clusterName string
+	if e.ComputeResource != nil {
+		clusterName = e.ComputeResource.Name
+	}
+	l.statsCollector.setLocation(EntityHost, name, clusterName, eventDatacenter(baseEvent))
+
+	return name
+}
+
+// eventDatacenter returns the name of the datacenter an event happened in, or
+// an empty string if the event doesn't say.
+func eventDatacenter(baseEvent types.BaseEvent) string {
+	e := baseEvent.GetEvent()
+	if e.Datacenter == nil {
+		return ""
+	}
+
+	return e.Datacenter.Name
+}
+
+// datacenterName returns the name of the datacenter a managed entity is in,
+// which is found by following its parents, since datacenters can be in folders
+// themselves. An empty string is returned if the entity isn't in a datacenter.
+func (l *VSphereEventListener) datacenterName(ctx context.Context, ref types.ManagedObjectReference) (string, error) {
+	collector := property.DefaultCollector(l.client.Client)
+	for {
+		var entity mo.ManagedEntity
+		err := collector.RetrieveOne(ctx, ref, []string{"name", "parent"}, &entity)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to look up parent of entity with ID %s", ref)
+		}
+		if ref.Type == "Datacenter" {
+			return entity.Name, nil
+		}
+		if entity.Parent == nil {
+			return "", nil
+		}
+		ref = *entity.Parent
+	}
+}
@@ -0,0 +1,185 @@
+package collectdvsphere
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// checkpointWindow is how long before the newest handled event an event can
+// have been created and still be recognised as a new event. The keys of the
+// events handled within it are remembered, and events created before it are
+// assumed to have been handled already. Event keys are shared by every cluster,
+// so a window of keys would be used up faster by busy clusters than by quiet
+// ones.
+const checkpointWindow = 10 * time.Minute
+
+// checkpointPruneInterval is how far the window has to move before the keys of
+// events that left it are forgotten.
+const checkpointPruneInterval = time.Minute
+
+// An eventCheckpoint keeps track of which vSphere events have been handled.
+// This is used to make sure that events that are seen more than once (the
+// latest page of an event collector overlaps with the previous one, and events
+// are replayed after a reconnect) are only counted once, and to know where to
+// resume after a restart.
+type eventCheckpoint struct {
+	path string
+
+	lastKey  int32
+	lastTime time.Time
+
+	// Any event created before floorTime is considered handled, as is any key
+	// in seen, which maps to when the event was created.
+	floorTime time.Time
+	seen      map[int32]time.Time
+
+	// Whether any events have been handled since the checkpoint was last saved.
+	dirty bool
+}
+
+// eventCheckpointState is what's stored in the checkpoint file.
+type eventCheckpointState struct {
+	LastKey  int32               `json:"last_key"`
+	LastTime time.Time           `json:"last_time"`
+	Handled  map[int32]time.Time `json:"handled,omitempty"`
+}
+
+// newEventCheckpoint returns an empty checkpoint that's stored at the given
+// path. If the path is empty, the checkpoint is only kept in memory.
+func newEventCheckpoint(path string) *eventCheckpoint {
+	return &eventCheckpoint{
+		path: path,
+		seen: make(map[int32]time.Time),
+	}
+}
+
+// load reads the checkpoint from its file. It's not an error for the file to
+// not exist yet.
+func (c *eventCheckpoint) load() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read event checkpoint file %s", c.path)
+	}
+
+	var state eventCheckpointState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse event checkpoint file %s", c.path)
+	}
+
+	c.restore(state)
+	return nil
+}
+
+// restore resumes from a saved checkpoint state.
+func (c *eventCheckpoint) restore(state eventCheckpointState) {
+	c.lastKey = state.LastKey
+	c.lastTime = state.LastTime
+	c.floorTime = state.LastTime.Add(-checkpointWindow)
+	c.seen = make(map[int32]time.Time, len(state.Handled))
+	for key, createdTime := range state.Handled {
+		c.seen[key] = createdTime
+	}
+}
+
+// state returns the state of the checkpoint that's saved.
+func (c *eventCheckpoint) state() eventCheckpointState {
+	handled := make(map[int32]time.Time, len(c.seen))
+	for key, createdTime := range c.seen {
+		handled[key] = createdTime
+	}
+
+	return eventCheckpointState{
+		LastKey:  c.lastKey,
+		LastTime: c.lastTime,
+		Handled:  handled,
+	}
+}
+
+// replayFrom returns the time that events have to be replayed from to not miss
+// any, or the zero time if no events were handled yet.
+func (c *eventCheckpoint) replayFrom() time.Time {
+	if c.lastTime.IsZero() {
+		return time.Time{}
+	}
+
+	return c.floorTime
+}
+
+// handled returns whether an event was already handled.
+func (c *eventCheckpoint) handled(e *types.Event) bool {
+	if e.CreatedTime.Before(c.floorTime) {
+		return true
+	}
+
+	_, ok := c.seen[e.Key]
+	return ok
+}
+
+// markHandled records that an event has been handled. It returns false if the
+// event was already handled before.
+func (c *eventCheckpoint) markHandled(e *types.Event) bool {
+	if c.handled(e) {
+		return false
+	}
+
+	c.seen[e.Key] = e.CreatedTime
+	c.dirty = true
+	if e.Key > c.lastKey {
+		c.lastKey = e.Key
+	}
+	if e.CreatedTime.After(c.lastTime) {
+		c.lastTime = e.CreatedTime
+	}
+
+	if floor := c.lastTime.Add(-checkpointWindow); floor.Sub(c.floorTime) >= checkpointPruneInterval {
+		c.floorTime = floor
+		for key, createdTime := range c.seen {
+			if createdTime.Before(floor) {
+				delete(c.seen, key)
+			}
+		}
+	}
+
+	return true
+}
+
+// save writes the checkpoint to its file, if any events were handled since it
+// was last saved.
+func (c *eventCheckpoint) save() error {
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.state())
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event checkpoint")
+	}
+
+	// Write to a temporary file first, so that a crash while writing doesn't
+	// leave a truncated checkpoint behind.
+	tmpPath := c.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write event checkpoint file %s", tmpPath)
+	}
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to move event checkpoint file into place at %s", c.path)
+	}
+
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,96 @@
+package collectdvsphere
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestEventCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+	createdTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	checkpoint := newEventCheckpoint(path)
+	err = checkpoint.load()
+	if err != nil {
+		t.Fatalf("failed to load missing checkpoint: %v", err)
+	}
+
+	if !checkpoint.markHandled(&types.Event{Key: 10, CreatedTime: createdTime}) {
+		t.Error("expected event 10 to be new")
+	}
+	if !checkpoint.markHandled(&types.Event{Key: 8, CreatedTime: createdTime.Add(-time.Second)}) {
+		t.Error("expected event 8 to be new")
+	}
+	if checkpoint.markHandled(&types.Event{Key: 10, CreatedTime: createdTime}) {
+		t.Error("expected event 10 to be handled already")
+	}
+
+	err = checkpoint.save()
+	if err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+
+	restored := newEventCheckpoint(path)
+	err = restored.load()
+	if err != nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+
+	if restored.lastKey != 10 || !restored.lastTime.Equal(createdTime) {
+		t.Errorf("expected checkpoint to be at event 10 at %s, but was at %d at %s", createdTime, restored.lastKey, restored.lastTime)
+	}
+	if restored.markHandled(&types.Event{Key: 8, CreatedTime: createdTime.Add(-time.Second)}) {
+		t.Error("expected event 8 to be handled already after restoring checkpoint")
+	}
+	if !restored.markHandled(&types.Event{Key: 9, CreatedTime: createdTime}) {
+		t.Error("expected event 9 to be new after restoring checkpoint")
+	}
+	if !restored.markHandled(&types.Event{Key: 11, CreatedTime: createdTime}) {
+		t.Error("expected event 11 to be new after restoring checkpoint")
+	}
+	if restored.markHandled(&types.Event{Key: 7, CreatedTime: createdTime.Add(-time.Hour)}) {
+		t.Error("expected event 7 from before the window to be handled already after restoring checkpoint")
+	}
+	if replayFrom := restored.replayFrom(); !replayFrom.Equal(createdTime.Add(-checkpointWindow)) {
+		t.Errorf("expected events to be replayed from %s, but were replayed from %s", createdTime.Add(-checkpointWindow), replayFrom)
+	}
+}
+
+func TestEventCheckpointBusyCluster(t *testing.T) {
+	createdTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	checkpoint := newEventCheckpoint("")
+
+	// Another cluster can have far more events than fit in a page of a quiet
+	// cluster, whose events then arrive with much lower keys.
+	if !checkpoint.markHandled(&types.Event{Key: 100000, CreatedTime: createdTime}) {
+		t.Error("expected event 100000 to be new")
+	}
+	if !checkpoint.markHandled(&types.Event{Key: 10, CreatedTime: createdTime.Add(-time.Minute)}) {
+		t.Error("expected event 10 of the quiet cluster to be new")
+	}
+	if checkpoint.markHandled(&types.Event{Key: 10, CreatedTime: createdTime.Add(-time.Minute)}) {
+		t.Error("expected event 10 to be handled already")
+	}
+
+	// Events that leave the window are forgotten.
+	if !checkpoint.markHandled(&types.Event{Key: 100001, CreatedTime: createdTime.Add(time.Hour)}) {
+		t.Error("expected event 100001 to be new")
+	}
+	if _, ok := checkpoint.seen[10]; ok {
+		t.Error("expected event 10 to be forgotten after leaving the window")
+	}
+	if checkpoint.markHandled(&types.Event{Key: 11, CreatedTime: createdTime}) {
+		t.Error("expected event 11 from before the window to be handled already")
+	}
+}
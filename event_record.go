@@ -0,0 +1,78 @@
+package collectdvsphere
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// An EventRecord describes a vSphere event handled by a VSphereEventListener,
+// with the names of the entities as they appear on the event.
+type EventRecord struct {
+	Key         int32     `json:"key"`
+	ChainID     int32     `json:"chain_id"`
+	Type        string    `json:"type"`
+	CreatedTime time.Time `json:"created_time"`
+	Host        string    `json:"host,omitempty"`
+	VM          string    `json:"vm,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Fault       string    `json:"fault,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// An EventRecorder is given every event handled by a VSphereEventListener,
+// before the event is counted by the StatsCollector.
+type EventRecorder interface {
+	RecordEvent(record EventRecord) error
+}
+
+// newEventRecord returns an EventRecord describing the given event.
+func newEventRecord(baseEvent types.BaseEvent) EventRecord {
+	e := baseEvent.GetEvent()
+
+	record := EventRecord{
+		Key:         e.Key,
+		ChainID:     e.ChainId,
+		Type:        strings.TrimPrefix(fmt.Sprintf("%T", baseEvent), "*types."),
+		CreatedTime: e.CreatedTime,
+		User:        e.UserName,
+		Message:     e.FullFormattedMessage,
+	}
+	if e.Host != nil {
+		record.Host = e.Host.Name
+	}
+	if e.Vm != nil {
+		record.VM = e.Vm.Name
+	}
+
+	var reason *types.LocalizedMethodFault
+	switch e := baseEvent.(type) {
+	case *types.VmFailedToPowerOnEvent:
+		reason = &e.Reason
+	case *types.VmFailedToPowerOffEvent:
+		reason = &e.Reason
+	case *types.VmFailedMigrateEvent:
+		reason = &e.Reason
+	case *types.VmCloneFailedEvent:
+		reason = &e.Reason
+	}
+	if reason != nil {
+		record.Fault = faultDescription(reason)
+	}
+
+	return record
+}
+
+// faultDescription returns the localized message of a fault, or the type of
+// the fault if it doesn't have a message.
+func faultDescription(fault *types.LocalizedMethodFault) string {
+	if fault.LocalizedMessage != "" {
+		return fault.LocalizedMessage
+	}
+	if fault.Fault != nil {
+		return strings.TrimPrefix(fmt.Sprintf("%T", fault.Fault), "*types.")
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package collectdvsphere
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/pkg/errors"
+)
+
+// DefaultGraphitePathTemplate is the path template that results in the same
+// paths as collectd's write_graphite plugin.
+const DefaultGraphitePathTemplate = "{entity}.vsphere-{plugin_instance}.{type}-{name}"
+
+// graphiteWriteTimeout is how long a GraphiteWriter waits for carbon to accept
+// the metrics of an interval.
+const graphiteWriteTimeout = 30 * time.Second
+
+// A GraphiteWriter is a MetricWriter that sends metrics to carbon using the
+// Graphite plaintext protocol over TCP.
+//
+// The path of each metric is the prefix followed by the path template, in
+// which {entity_kind}, {entity}, {cluster}, {datacenter}, {plugin_instance},
+// {type} and {name} are replaced by those fields of the metric. Dots and
+// spaces in the fields are replaced by underscores, so they don't add levels
+// to the path.
+type GraphiteWriter struct {
+	address  string
+	prefix   string
+	template string
+
+	conn net.Conn
+}
+
+// NewGraphiteWriter returns a GraphiteWriter that sends metrics to carbon at
+// the given host:port. The connection is made when metrics are first written,
+// and made again after a write fails.
+func NewGraphiteWriter(address, prefix, template string) *GraphiteWriter {
+	if template == "" {
+		template = DefaultGraphitePathTemplate
+	}
+
+	return &GraphiteWriter{
+		address:  address,
+		prefix:   prefix,
+		template: template,
+	}
+}
+
+func (w *GraphiteWriter) WriteMetrics(metrics []Metric) error {
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		var value string
+		switch v := metric.Value.(type) {
+		case api.Derive:
+			value = strconv.FormatInt(int64(v), 10)
+		case api.Gauge:
+			value = strconv.FormatFloat(float64(v), 'g', -1, 64)
+		case api.Counter:
+			value = strconv.FormatUint(uint64(v), 10)
+		default:
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s %s %d\n", w.path(metric), value, metric.Time.Unix())
+	}
+
+	if w.conn == nil {
+		conn, err := net.DialTimeout("tcp", w.address, graphiteWriteTimeout)
+		if err != nil {
+			return errors.Wrapf(err, "failed to connect to graphite at %s", w.address)
+		}
+		w.conn = conn
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(graphiteWriteTimeout))
+	_, err := w.conn.Write(buf.Bytes())
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return errors.Wrap(err, "failed to write metrics to graphite")
+	}
+
+	return nil
+}
+
+// Close closes the connection to carbon, if there is one.
+func (w *GraphiteWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *GraphiteWriter) path(metric Metric) string {
+	path := strings.NewReplacer(
+		"{entity_kind}", graphitePathComponent(metric.EntityKind),
+		"{entity}", graphitePathComponent(metric.Entity),
+		"{cluster}", graphitePathComponent(metric.Cluster),
+		"{datacenter}", graphitePathComponent(metric.Datacenter),
+		"{plugin_instance}", graphitePathComponent(metric.PluginInstance),
+		"{type}", graphitePathComponent(metric.Type),
+		"{name}", graphitePathComponent(metric.Name),
+	).Replace(w.template)
+
+	if w.prefix == "" {
+		return path
+	}
+	return strings.TrimSuffix(w.prefix, ".") + "." + path
+}
+
+// graphitePathComponent replaces the characters that would change the meaning
+// of a Graphite path in a component of one.
+func graphitePathComponent(component string) string {
+	return strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_").Replace(component)
+}
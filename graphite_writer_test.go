@@ -0,0 +1,56 @@
+package collectdvsphere
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestGraphiteWriter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	writer := NewGraphiteWriter(listener.Addr().String(), "travis.", "")
+
+	statTime := time.Unix(1500000000, 0)
+	err = writer.WriteMetrics([]Metric{
+		{EntityKind: EntityHost, Entity: "host-1.example.com", Type: "operations", Name: "power_on_success", PluginInstance: "foo-instance", Time: statTime, Value: api.Derive(3)},
+		{EntityKind: EntityBaseVM, Entity: "image", Type: "duration", Name: "clone_p95", PluginInstance: "foo-instance", Time: statTime, Value: api.Gauge(2.5)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+	writer.Close()
+
+	expected := "travis.host-1_example_com.vsphere-foo-instance.operations-power_on_success 3 1500000000\n" +
+		"travis.image.vsphere-foo-instance.duration-clone_p95 2.5 1500000000\n"
+	if data := <-received; data != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestGraphiteWriterPathTemplate(t *testing.T) {
+	writer := NewGraphiteWriter("", "", "vsphere.{plugin_instance}.{entity_kind}.{entity}.{name}")
+
+	path := writer.path(Metric{EntityKind: EntityBaseVM, Entity: "image 1", Type: "operations", Name: "clone_success", PluginInstance: "foo"})
+	if expected := "vsphere.foo.base_vm.image_1.clone_success"; path != expected {
+		t.Errorf("expected path %q, got %q", expected, path)
+	}
+}
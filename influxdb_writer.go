@@ -0,0 +1,120 @@
+package collectdvsphere
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/pkg/errors"
+)
+
+// influxDBWriteTimeout is how long an InfluxDBWriter waits for InfluxDB to
+// accept the metrics of an interval.
+const influxDBWriteTimeout = 30 * time.Second
+
+// An InfluxDBWriter is a MetricWriter that writes metrics to InfluxDB using the
+// line protocol over HTTP.
+//
+// Each metric is written as a field named after the metric, in a measurement
+// named vsphere_<type> (such as vsphere_operations), with a host, base_vm,
+// vcenter or sink tag, cluster and datacenter tags if they're known, and a
+// plugin_instance tag.
+type InfluxDBWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewInfluxDBWriter returns an InfluxDBWriter that posts metrics to the given
+// write URL, including its query parameters, such as
+// http://influxdb:8086/write?db=vsphere for InfluxDB 1.x or
+// http://influxdb:8086/api/v2/write?org=travis&bucket=vsphere for InfluxDB 2.x.
+// The timestamps are written in nanoseconds, which is the default precision.
+//
+// If token is set, it's sent as an InfluxDB 2.x API token. InfluxDB 1.x
+// credentials can be included in the URL.
+func NewInfluxDBWriter(url, token string) *InfluxDBWriter {
+	return &InfluxDBWriter{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: influxDBWriteTimeout},
+	}
+}
+
+func (w *InfluxDBWriter) WriteMetrics(metrics []Metric) error {
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		line, ok := influxDBLine(metric)
+		if !ok {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", w.url, &buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create influxdb write request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to write metrics to influxdb")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		return errors.Errorf("influxdb responded with status %d to write: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// influxDBLine returns a metric in the InfluxDB line protocol. It returns false
+// if the metric's value can't be written.
+func influxDBLine(metric Metric) (string, bool) {
+	var value string
+	switch v := metric.Value.(type) {
+	case api.Derive:
+		value = strconv.FormatInt(int64(v), 10) + "i"
+	case api.Gauge:
+		value = strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case api.Counter:
+		value = strconv.FormatUint(uint64(v), 10) + "i"
+	default:
+		return "", false
+	}
+
+	tags := fmt.Sprintf("%s=%s", metric.EntityKind, influxDBEscape(metric.Entity))
+	if metric.Cluster != "" {
+		tags += ",cluster=" + influxDBEscape(metric.Cluster)
+	}
+	if metric.Datacenter != "" {
+		tags += ",datacenter=" + influxDBEscape(metric.Datacenter)
+	}
+	if metric.PluginInstance != "" {
+		tags += ",plugin_instance=" + influxDBEscape(metric.PluginInstance)
+	}
+
+	return fmt.Sprintf("vsphere_%s,%s %s=%s %d", influxDBEscape(metric.Type), tags, influxDBEscape(metric.Name), value, metric.Time.UnixNano()), true
+}
+
+// influxDBEscape escapes the characters that have a special meaning in the
+// line protocol in a measurement name, tag or field key, or tag value.
+func influxDBEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,62 @@
+package collectdvsphere
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestInfluxDBWriter(t *testing.T) {
+	var body, authorization, query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+		authorization = req.Header.Get("Authorization")
+		query = req.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer := NewInfluxDBWriter(server.URL+"/api/v2/write?org=travis&bucket=vsphere", "secret")
+
+	statTime := time.Unix(1500000000, 0)
+	err := writer.WriteMetrics([]Metric{
+		{EntityKind: EntityHost, Entity: "host 1", Cluster: "cluster,1", Type: "operations", Name: "power_on_success", PluginInstance: "foo-instance", Time: statTime, Value: api.Derive(3)},
+		{EntityKind: EntityBaseVM, Entity: "image", Type: "duration", Name: "clone_p95", PluginInstance: "foo-instance", Time: statTime, Value: api.Gauge(2.5)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected := `vsphere_operations,host=host\ 1,cluster=cluster\,1,plugin_instance=foo-instance power_on_success=3i 1500000000000000000` + "\n" +
+		`vsphere_duration,base_vm=image,plugin_instance=foo-instance clone_p95=2.5 1500000000000000000` + "\n"
+	if body != expected {
+		t.Errorf("expected body %q, got %q", expected, body)
+	}
+	if authorization != "Token secret" {
+		t.Errorf("expected token authorization, got %q", authorization)
+	}
+	if query != "org=travis&bucket=vsphere" {
+		t.Errorf("expected query to be kept, got %q", query)
+	}
+}
+
+func TestInfluxDBWriterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	writer := NewInfluxDBWriter(server.URL+"/write?db=missing", "")
+
+	err := writer.WriteMetrics([]Metric{
+		{EntityKind: EntityHost, Entity: "host", Type: "operations", Name: "power_on_success", Value: api.Derive(1)},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a failed write")
+	}
+}
@@ -0,0 +1,123 @@
+package collectdvsphere
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/pkg/errors"
+)
+
+// A JSONLinesWriter appends the handled vSphere events and the metrics of
+// every interval to a file as JSON lines. It's both a MetricWriter and an
+// EventRecorder.
+//
+// Each line is an object with a "record" field that's either "event", with the
+// fields of an EventRecord in an "event" object, or "metrics", with the time
+// of the interval and all metric values in a "metrics" array.
+type JSONLinesWriter struct {
+	mutex sync.Mutex
+	file  *rotatingFile
+}
+
+// NewJSONLinesWriter returns a JSONLinesWriter that appends to the file at the
+// given path. Once the file grows past maxSize bytes it's moved to path.1, and
+// older files are moved up until there are maxBackups of them. If maxSize is
+// 0, the file is never rotated.
+func NewJSONLinesWriter(path string, maxSize int64, maxBackups int) *JSONLinesWriter {
+	return &JSONLinesWriter{
+		file: newRotatingFile(path, maxSize, maxBackups),
+	}
+}
+
+type jsonLinesEvent struct {
+	Record string      `json:"record"`
+	Event  EventRecord `json:"event"`
+}
+
+type jsonLinesMetrics struct {
+	Record  string           `json:"record"`
+	Time    time.Time        `json:"time"`
+	Metrics []jsonLineMetric `json:"metrics"`
+}
+
+type jsonLineMetric struct {
+	EntityKind     string      `json:"entity_kind"`
+	Entity         string      `json:"entity"`
+	Cluster        string      `json:"cluster,omitempty"`
+	Datacenter     string      `json:"datacenter,omitempty"`
+	PluginInstance string      `json:"plugin_instance"`
+	Type           string      `json:"type"`
+	Name           string      `json:"name"`
+	Value          interface{} `json:"value"`
+}
+
+// RecordEvent appends an event to the file.
+func (w *JSONLinesWriter) RecordEvent(record EventRecord) error {
+	return w.writeLine(jsonLinesEvent{
+		Record: "event",
+		Event:  record,
+	})
+}
+
+// WriteMetrics appends the metrics of an interval to the file as one line.
+func (w *JSONLinesWriter) WriteMetrics(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	line := jsonLinesMetrics{
+		Record:  "metrics",
+		Time:    metrics[0].Time,
+		Metrics: make([]jsonLineMetric, 0, len(metrics)),
+	}
+	for _, metric := range metrics {
+		var value interface{}
+		switch v := metric.Value.(type) {
+		case api.Derive:
+			value = int64(v)
+		case api.Gauge:
+			value = float64(v)
+		case api.Counter:
+			value = uint64(v)
+		default:
+			continue
+		}
+
+		line.Metrics = append(line.Metrics, jsonLineMetric{
+			EntityKind:     metric.EntityKind,
+			Entity:         metric.Entity,
+			Cluster:        metric.Cluster,
+			Datacenter:     metric.Datacenter,
+			PluginInstance: metric.PluginInstance,
+			Type:           metric.Type,
+			Name:           metric.Name,
+			Value:          value,
+		})
+	}
+
+	return w.writeLine(line)
+}
+
+// Close closes the file.
+func (w *JSONLinesWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
+
+func (w *JSONLinesWriter) writeLine(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode json line")
+	}
+	data = append(data, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, err = w.file.Write(data)
+	return err
+}
@@ -0,0 +1,101 @@
+package collectdvsphere
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestJSONLinesWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	writer := NewJSONLinesWriter(path, 0, 0)
+
+	err = writer.RecordEvent(EventRecord{Key: 1, Type: "VmPoweredOnEvent", Host: "host-1", VM: "vm-1"})
+	if err != nil {
+		t.Fatalf("unexpected error recording event: %v", err)
+	}
+	err = writer.WriteMetrics([]Metric{
+		{EntityKind: EntityHost, Entity: "host-1", Type: "operations", Name: "power_on_success", PluginInstance: "foo-instance", Time: time.Unix(1500000000, 0), Value: api.Derive(1)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+	writer.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("failed to parse line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[0]["record"] != "event" || lines[0]["event"].(map[string]interface{})["vm"] != "vm-1" {
+		t.Errorf("unexpected event line: %v", lines[0])
+	}
+	metric := lines[1]["metrics"].([]interface{})[0].(map[string]interface{})
+	if lines[1]["record"] != "metrics" || metric["name"] != "power_on_success" || metric["value"] != float64(1) {
+		t.Errorf("unexpected metrics line: %v", lines[1])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectd-vsphere")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	file := newRotatingFile(path, 10, 2)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := file.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	file.Close()
+
+	expectedContents := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for path, expected := range expectedContents {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if string(data) != expected {
+			t.Errorf("expected %s to contain %q, got %q", path, expected, string(data))
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+}
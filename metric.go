@@ -0,0 +1,74 @@
+package collectdvsphere
+
+import (
+	"time"
+
+	"collectd.org/api"
+)
+
+// The kinds of entities that metrics are reported for.
+const (
+	EntityHost    = "host"
+	EntityBaseVM  = "base_vm"
+	EntityVCenter = "vcenter"
+	EntitySink    = "sink"
+)
+
+// A Metric is the value of a single series tracked by a StatsCollector at a
+// point in time.
+type Metric struct {
+	// The kind of entity the metric is about (EntityHost, EntityBaseVM,
+	// EntityVCenter or EntitySink) and the name of that entity.
+	EntityKind string
+	Entity     string
+
+	// The names of the compute cluster and datacenter the entity is in, if
+	// they're known. Only hosts are in a cluster.
+	Cluster    string
+	Datacenter string
+
+	// The collectd type of the metric, such as "operations" or "duration",
+	// and the name of the metric, such as "power_on_success".
+	Type string
+	Name string
+
+	PluginInstance string
+	Time           time.Time
+	Interval       time.Duration
+	Value          api.Value
+}
+
+// ValueList returns the metric as a collectd value list, with the entity as
+// the host and the metric name as the type instance.
+func (m Metric) ValueList() api.ValueList {
+	var valueList api.ValueList
+	valueList.Identifier.Host = m.Entity
+	valueList.Identifier.Plugin = "vsphere"
+	valueList.Identifier.PluginInstance = m.PluginInstance
+	valueList.Identifier.Type = m.Type
+	valueList.Identifier.TypeInstance = m.Name
+	valueList.Time = m.Time
+	valueList.Interval = m.Interval
+	valueList.Values = []api.Value{m.Value}
+
+	return valueList
+}
+
+// LocationValueList returns the metric as a collectd value list like
+// ValueList, but with the datacenter and cluster of the entity added to the
+// plugin instance, as <plugin instance>-<datacenter>-<cluster>. Unknown parts
+// are left out.
+func (m Metric) LocationValueList() api.ValueList {
+	valueList := m.ValueList()
+	for _, part := range []string{m.Datacenter, m.Cluster} {
+		if part == "" {
+			continue
+		}
+		if valueList.Identifier.PluginInstance != "" {
+			valueList.Identifier.PluginInstance += "-"
+		}
+		valueList.Identifier.PluginInstance += part
+	}
+
+	return valueList
+}
@@ -0,0 +1,202 @@
+package collectdvsphere
+
+import (
+	"time"
+)
+
+// The kinds of values a metric family can track.
+const (
+	// A counter family counts events, and is reported as an "operations"
+	// derive.
+	familyCounter = iota
+
+	// A duration family collects durations, and is reported as the "duration"
+	// gauges of the summary of the last complete interval.
+	familyDuration
+
+	// A gauge family holds the current value of something, and is reported as
+	// a "gauge" gauge.
+	familyGauge
+)
+
+// A metricFamily is a named metric that's tracked for every entity of a
+// kind, such as the number of successful power-ons on each host.
+type metricFamily struct {
+	entityKind string
+	name       string
+	kind       int
+
+	// How often the family is written, or 0 to write it at the interval of
+	// the StatsCollector, and when it's due to be written next.
+	interval  time.Duration
+	nextWrite time.Time
+
+	counters  map[string]int64
+	durations map[string]*durationStats
+	gauges    map[string]float64
+}
+
+// ensure adds an entity to the family with a zero value, if it's not in the
+// family already.
+func (f *metricFamily) ensure(entity string) {
+	switch f.kind {
+	case familyCounter:
+		if _, ok := f.counters[entity]; !ok {
+			f.counters[entity] = 0
+		}
+	case familyDuration:
+		if _, ok := f.durations[entity]; !ok {
+			f.durations[entity] = &durationStats{}
+		}
+	case familyGauge:
+		if _, ok := f.gauges[entity]; !ok {
+			f.gauges[entity] = 0
+		}
+	}
+}
+
+// entityNames returns the names of the entities in the family.
+func (f *metricFamily) entityNames() []string {
+	var names []string
+	for entity := range f.counters {
+		names = append(names, entity)
+	}
+	for entity := range f.durations {
+		names = append(names, entity)
+	}
+	for entity := range f.gauges {
+		names = append(names, entity)
+	}
+
+	return names
+}
+
+// A metricRegistry holds the metric families tracked by a StatsCollector.
+// Adding an entity to the registry adds it to every family for that kind of
+// entity, so that all of its series are reported from then on, even before
+// anything has happened to it.
+type metricRegistry struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{
+		byName: make(map[string]*metricFamily),
+	}
+}
+
+// register adds a metric family with the given kind of entity, name and kind
+// of value. The names of families have to be unique.
+func (r *metricRegistry) register(entityKind, name string, kind int) {
+	family := &metricFamily{
+		entityKind: entityKind,
+		name:       name,
+		kind:       kind,
+		counters:   make(map[string]int64),
+		durations:  make(map[string]*durationStats),
+		gauges:     make(map[string]float64),
+	}
+
+	r.families = append(r.families, family)
+	r.byName[name] = family
+}
+
+// family returns the metric family with the given name and kind of value, or
+// nil if there's no such family.
+func (r *metricRegistry) family(name string, kind int) *metricFamily {
+	family, ok := r.byName[name]
+	if !ok || family.kind != kind {
+		return nil
+	}
+
+	return family
+}
+
+// ensureEntity adds an entity to every family for its kind of entity.
+func (r *metricRegistry) ensureEntity(entityKind, entity string) {
+	for _, family := range r.families {
+		if family.entityKind == entityKind {
+			family.ensure(entity)
+		}
+	}
+}
+
+// increment increases the counter of an entity in a counter family by one,
+// and adds the entity to the other families for its kind of entity. It returns
+// false if there's no such counter family.
+func (r *metricRegistry) increment(name, entity string) bool {
+	return r.add(name, entity, 1)
+}
+
+// add increases the counter of an entity in a counter family by delta, and
+// adds the entity to the other families for its kind of entity. It returns
+// false if there's no such counter family.
+func (r *metricRegistry) add(name, entity string, delta int64) bool {
+	family := r.family(name, familyCounter)
+	if family == nil {
+		return false
+	}
+
+	r.ensureEntity(family.entityKind, entity)
+	family.counters[entity] += delta
+	return true
+}
+
+// observe records a duration of an entity in a duration family, and adds the
+// entity to the other families for its kind of entity. It returns false if
+// there's no such duration family.
+func (r *metricRegistry) observe(name, entity string, duration time.Duration) bool {
+	family := r.family(name, familyDuration)
+	if family == nil {
+		return false
+	}
+
+	r.ensureEntity(family.entityKind, entity)
+	family.durations[entity].add(duration)
+	return true
+}
+
+// setGauge sets the value of an entity in a gauge family. It returns false if
+// there's no such gauge family.
+func (r *metricRegistry) setGauge(name, entity string, value float64) bool {
+	family := r.family(name, familyGauge)
+	if family == nil {
+		return false
+	}
+
+	r.ensureEntity(family.entityKind, entity)
+	family.gauges[entity] = value
+	return true
+}
+
+// entities returns the names of all entities of a kind.
+func (r *metricRegistry) entities(entityKind string) []string {
+	seen := make(map[string]bool)
+	var entities []string
+	for _, family := range r.families {
+		if family.entityKind != entityKind {
+			continue
+		}
+
+		for _, entity := range family.entityNames() {
+			if !seen[entity] {
+				seen[entity] = true
+				entities = append(entities, entity)
+			}
+		}
+	}
+
+	return entities
+}
+
+// removeEntity removes an entity from every family for its kind of entity.
+func (r *metricRegistry) removeEntity(entityKind, entity string) {
+	for _, family := range r.families {
+		if family.entityKind == entityKind {
+			delete(family.counters, entity)
+			delete(family.durations, entity)
+			delete(family.gauges, entity)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package collectdvsphere
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricRegistry(t *testing.T) {
+	registry := newMetricRegistry()
+	registry.register(EntityHost, "power_on_success", familyCounter)
+	registry.register(EntityHost, "power_on", familyDuration)
+	registry.register(EntityBaseVM, "clone_success", familyCounter)
+
+	if !registry.increment("power_on_success", "host-1") {
+		t.Fatal("expected power_on_success to be a counter family")
+	}
+	if registry.increment("power_on", "host-1") {
+		t.Error("expected incrementing a duration family to fail")
+	}
+	if registry.observe("power_off", "host-1", time.Second) {
+		t.Error("expected observing an unknown family to fail")
+	}
+
+	if value := registry.byName["power_on_success"].counters["host-1"]; value != 1 {
+		t.Errorf("expected power_on_success of host-1 to be 1, but was %d", value)
+	}
+	if _, ok := registry.byName["power_on"].durations["host-1"]; !ok {
+		t.Error("expected host-1 to be added to the power_on family")
+	}
+	if _, ok := registry.byName["clone_success"].counters["host-1"]; ok {
+		t.Error("expected host-1 not to be added to a base VM family")
+	}
+}
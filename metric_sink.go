@@ -0,0 +1,93 @@
+package collectdvsphere
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSinkWriteTimeout is how long a StatsCollector waits for a sink to
+// accept the metrics of an interval, unless it's changed with
+// SetWriteTimeout.
+const defaultSinkWriteTimeout = 30 * time.Second
+
+// A metricSink is one of the MetricWriters that a StatsCollector writes its
+// metrics to. A sink failing to write doesn't stop the metrics from being
+// written to the other sinks, and the successful and failed writes of each
+// sink are reported as metrics about the sink.
+type metricSink struct {
+	name   string
+	writer MetricWriter
+
+	// Holds a value while a write to the sink is in progress, so that a
+	// write that timed out doesn't overlap with the next one.
+	busy chan struct{}
+}
+
+func newMetricSink(name string, writer MetricWriter) *metricSink {
+	return &metricSink{
+		name:   name,
+		writer: writer,
+		busy:   make(chan struct{}, 1),
+	}
+}
+
+// write writes the metrics to the sink, giving up after the timeout. A write
+// that times out keeps going in the background, and the sink is skipped until
+// it finishes.
+func (s *metricSink) write(metrics []Metric, timeout time.Duration) error {
+	select {
+	case s.busy <- struct{}{}:
+	default:
+		return errors.Errorf("failed to write metrics to %s, since the previous write is still in progress", s.name)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := s.writer.WriteMetrics(metrics)
+		<-s.busy
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrapf(err, "failed to write metrics to %s", s.name)
+		}
+		return nil
+	case <-timer.C:
+		return errors.Errorf("timed out writing metrics to %s after %s", s.name, timeout)
+	}
+}
+
+// A queueingMetricWriter is a MetricWriter that queues metrics it couldn't
+// write, such as a CollectdWriter. queueStats returns the current length of
+// the queue and the number of metrics dropped from it since it was last
+// called.
+type queueingMetricWriter interface {
+	queueStats() (length int, dropped int64)
+}
+
+// A counterBaselineWriter is a MetricWriter that writes how much counters
+// changed rather than their values, such as a StatsDWriter. setCounterBaseline
+// gives it the values of counters restored from a counter state file, so that
+// it doesn't write their whole values as changes after a restart.
+type counterBaselineWriter interface {
+	setCounterBaseline(metrics []Metric)
+}
+
+// sinkErrors is the error returned when writing to one or more sinks failed.
+type sinkErrors []error
+
+func (e sinkErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,101 @@
+package collectdvsphere
+
+import (
+	"sync"
+
+	"collectd.org/api"
+	"github.com/pkg/errors"
+)
+
+// A MetricWriter sends metrics somewhere, such as to collectd or a StatsD
+// agent. The StatsCollector calls WriteMetrics once every interval with the
+// current value of every metric.
+type MetricWriter interface {
+	WriteMetrics(metrics []Metric) error
+}
+
+// A CollectdWriter is a MetricWriter that writes metrics as value lists to an
+// api.Writer, such as a collectd network client.
+//
+// Value lists that can't be written are kept in a bounded queue and written
+// again the next time WriteMetrics is called, which is once every interval,
+// before the new value lists. If that fails, the new value lists are queued
+// behind them, so that every series is written in order. Once the queue is
+// full, the oldest value lists are dropped.
+type CollectdWriter struct {
+	writer   api.Writer
+	location bool
+
+	mutex sync.Mutex
+	queue *retryQueue
+}
+
+// NewCollectdWriter returns a CollectdWriter that writes metrics as value lists
+// to the given api.Writer, such as a collectd network client.
+func NewCollectdWriter(writer api.Writer) *CollectdWriter {
+	return &CollectdWriter{
+		writer: writer,
+		queue:  newRetryQueue(defaultRetryQueueSize),
+	}
+}
+
+// NewCollectdLocationWriter returns a CollectdWriter like NewCollectdWriter,
+// except that the datacenter and cluster of each metric are added to its
+// plugin instance, so that they're part of the collectd identifier.
+func NewCollectdLocationWriter(writer api.Writer) *CollectdWriter {
+	w := NewCollectdWriter(writer)
+	w.location = true
+	return w
+}
+
+// SetRetryQueueSize sets the number of value lists that are kept to be written
+// again after writing them failed. A negative size is treated as 0, which
+// turns retrying off.
+func (w *CollectdWriter) SetRetryQueueSize(size int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.queue.setMaxSize(size)
+}
+
+func (w *CollectdWriter) WriteMetrics(metrics []Metric) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	valueLists := make([]api.ValueList, 0, len(metrics))
+	for _, metric := range metrics {
+		if w.location {
+			valueLists = append(valueLists, metric.LocationValueList())
+		} else {
+			valueLists = append(valueLists, metric.ValueList())
+		}
+	}
+
+	err := w.queue.retry(w.writer.Write)
+	if err != nil {
+		w.queue.push(valueLists...)
+		return errors.Wrap(err, "failed to write queued metrics")
+	}
+
+	for i, valueList := range valueLists {
+		err := w.writer.Write(valueList)
+		if err != nil {
+			w.queue.push(valueLists[i:]...)
+			return errors.Wrapf(err, "failed to write %s metric", metrics[i].Name)
+		}
+	}
+
+	return nil
+}
+
+// queueStats returns the number of value lists waiting to be written again,
+// and the number of value lists that were dropped because the queue was full
+// since queueStats was last called.
+func (w *CollectdWriter) queueStats() (length int, dropped int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	dropped = w.queue.dropped
+	w.queue.dropped = 0
+	return len(w.queue.valueLists), dropped
+}
@@ -0,0 +1,152 @@
+package collectdvsphere
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/exec"
+	"collectd.org/format"
+)
+
+type flakyAPIWriter struct {
+	failing bool
+	written []string
+}
+
+func (w *flakyAPIWriter) Write(vl api.ValueList) error {
+	if w.failing {
+		return errors.New("collectd is down")
+	}
+
+	w.written = append(w.written, vl.Identifier.TypeInstance)
+	return nil
+}
+
+func TestCollectdWriterRetries(t *testing.T) {
+	apiWriter := &flakyAPIWriter{failing: true}
+	writer := NewCollectdWriter(apiWriter)
+
+	metric := func(name string) Metric {
+		return Metric{EntityKind: EntityHost, Entity: "host-1", Type: "operations", Name: name, Value: api.Derive(1)}
+	}
+
+	err := writer.WriteMetrics([]Metric{metric("a"), metric("b")})
+	if err == nil {
+		t.Error("expected an error while collectd is down")
+	}
+
+	// New metrics are queued behind the failed ones while collectd is still
+	// down.
+	err = writer.WriteMetrics([]Metric{metric("c")})
+	if err == nil {
+		t.Error("expected an error while collectd is down")
+	}
+	if length, _ := writer.queueStats(); length != 3 {
+		t.Errorf("expected 3 queued metrics, but there were %d", length)
+	}
+
+	// The queued metrics are retried at the next write once collectd is back.
+	apiWriter.failing = false
+	err = writer.WriteMetrics([]Metric{metric("d")})
+	if err != nil {
+		t.Fatalf("expected the queued metrics to be retried, but got error: %v", err)
+	}
+
+	if len(apiWriter.written) != 4 || apiWriter.written[0] != "a" || apiWriter.written[3] != "d" {
+		t.Errorf("expected a, b, c and d to be written in order, but got %v", apiWriter.written)
+	}
+	if length, _ := writer.queueStats(); length != 0 {
+		t.Errorf("expected the queue to be empty, but it had %d metrics", length)
+	}
+}
+
+func TestCollectdWriterDropsOldest(t *testing.T) {
+	apiWriter := &flakyAPIWriter{failing: true}
+	writer := NewCollectdWriter(apiWriter)
+	writer.SetRetryQueueSize(2)
+
+	err := writer.WriteMetrics([]Metric{
+		{Type: "operations", Name: "a", Value: api.Derive(1)},
+		{Type: "operations", Name: "b", Value: api.Derive(1)},
+		{Type: "operations", Name: "c", Value: api.Derive(1)},
+	})
+	if err == nil {
+		t.Error("expected an error while collectd is down")
+	}
+
+	length, dropped := writer.queueStats()
+	if length != 2 || dropped != 1 {
+		t.Errorf("expected 2 queued and 1 dropped metric, but got %d queued and %d dropped", length, dropped)
+	}
+	if writer.queue.valueLists[0].Identifier.TypeInstance != "b" {
+		t.Errorf("expected the oldest metric to be dropped, but the queue starts with %s", writer.queue.valueLists[0].Identifier.TypeInstance)
+	}
+}
+
+func TestCollectdWriterNegativeRetryQueueSize(t *testing.T) {
+	apiWriter := &flakyAPIWriter{failing: true}
+	writer := NewCollectdWriter(apiWriter)
+	writer.SetRetryQueueSize(-1)
+
+	err := writer.WriteMetrics([]Metric{
+		{Type: "operations", Name: "a", Value: api.Derive(1)},
+	})
+	if err == nil {
+		t.Error("expected an error while collectd is down")
+	}
+
+	length, dropped := writer.queueStats()
+	if length != 0 || dropped != 1 {
+		t.Errorf("expected nothing queued and 1 dropped metric, but got %d queued and %d dropped", length, dropped)
+	}
+}
+
+func TestCollectdWriterPutval(t *testing.T) {
+	oldInterval, hadInterval := os.LookupEnv("COLLECTD_INTERVAL")
+	os.Setenv("COLLECTD_INTERVAL", "15")
+	defer func() {
+		if hadInterval {
+			os.Setenv("COLLECTD_INTERVAL", oldInterval)
+		} else {
+			os.Unsetenv("COLLECTD_INTERVAL")
+		}
+	}()
+
+	nullLogger := newNullLogger()
+
+	var output bytes.Buffer
+	collector := newStatsCollector(nil, exec.Interval(), nullLogger, "foo-instance")
+	collector.AddSink("collectd-exec", NewCollectdWriter(format.NewPutval(&output)))
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.ObserveCloneDuration("yes-image", 2*time.Second)
+
+	err := collector.writeAt(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
+
+	putval := regexp.MustCompile(`^PUTVAL "[^"/]+/vsphere-foo-instance/[^"/]+" interval=15\.000 1483326245\.000:-?[0-9.e+]+$`)
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	for _, line := range lines {
+		if !putval.MatchString(line) {
+			t.Errorf("expected a PUTVAL line with an interval of 15 seconds, but got %q", line)
+		}
+	}
+
+	expected := `PUTVAL "on-yes-host/vsphere-foo-instance/operations-power_on_success" interval=15.000 1483326245.000:1`
+	found := false
+	for _, line := range lines {
+		if line == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected output to include %q, but got:\n%s", expected, output.String())
+	}
+}
@@ -0,0 +1,105 @@
+package collectdvsphere
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"collectd.org/api"
+)
+
+// PrometheusExporter is an http.Handler that serves the metrics of a
+// StatsCollector in the Prometheus text exposition format.
+//
+// Operation counters are exported as counters named vsphere_<name>_total,
+// durations as gauges named vsphere_<name>_seconds, and other gauges as gauges
+// named vsphere_<name>. Every metric has a label named after the kind of
+// entity it's about (host, base_vm, vcenter or sink), cluster and datacenter
+// labels if they're known, and a plugin_instance label.
+type PrometheusExporter struct {
+	statsCollector *StatsCollector
+}
+
+// NewPrometheusExporter returns a PrometheusExporter that serves the metrics of
+// the given StatsCollector.
+func NewPrometheusExporter(statsCollector *StatsCollector) *PrometheusExporter {
+	return &PrometheusExporter{
+		statsCollector: statsCollector,
+	}
+}
+
+type prometheusSample struct {
+	name   string
+	labels string
+	value  string
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var samples []prometheusSample
+	metricTypes := make(map[string]string)
+
+	for _, metric := range e.statsCollector.Metrics() {
+		var name, metricType, value string
+		switch v := metric.Value.(type) {
+		case api.Derive:
+			name = "vsphere_" + metric.Name + "_total"
+			metricType = "counter"
+			value = strconv.FormatInt(int64(v), 10)
+		case api.Gauge:
+			name = "vsphere_" + metric.Name
+			if metric.Type == "duration" {
+				name += "_seconds"
+			}
+			metricType = "gauge"
+			value = strconv.FormatFloat(float64(v), 'g', -1, 64)
+		default:
+			continue
+		}
+
+		labels := fmt.Sprintf("%s=%s", metric.EntityKind, quotePrometheusLabel(metric.Entity))
+		if metric.Cluster != "" {
+			labels += ",cluster=" + quotePrometheusLabel(metric.Cluster)
+		}
+		if metric.Datacenter != "" {
+			labels += ",datacenter=" + quotePrometheusLabel(metric.Datacenter)
+		}
+		labels += ",plugin_instance=" + quotePrometheusLabel(metric.PluginInstance)
+
+		metricTypes[name] = metricType
+		samples = append(samples, prometheusSample{
+			name:   name,
+			labels: labels,
+			value:  value,
+		})
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].name != samples[j].name {
+			return samples[i].name < samples[j].name
+		}
+		return samples[i].labels < samples[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	bw := bufio.NewWriter(w)
+	for i, sample := range samples {
+		if i == 0 || samples[i-1].name != sample.name {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", sample.name, metricTypes[sample.name])
+		}
+		fmt.Fprintf(bw, "%s{%s} %s\n", sample.name, sample.labels, sample.value)
+	}
+	bw.Flush()
+}
+
+// quotePrometheusLabel returns a label value quoted and escaped for the
+// Prometheus text format.
+func quotePrometheusLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
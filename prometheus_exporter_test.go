@@ -0,0 +1,49 @@
+package collectdvsphere
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.MarkCloneFailure(`no-"image"`)
+	collector.ObservePowerOnDuration("on-yes-host", 3*time.Second)
+
+	err := collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewPrometheusExporter(collector).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("expected text format content type, got %q", contentType)
+	}
+
+	body := recorder.Body.String()
+	expectedLines := []string{
+		"# TYPE vsphere_power_on_success_total counter",
+		`vsphere_power_on_success_total{host="on-yes-host",plugin_instance="foo-instance"} 2`,
+		`vsphere_power_on_failure_total{host="on-yes-host",plugin_instance="foo-instance"} 0`,
+		`vsphere_clone_failure_total{base_vm="no-\"image\"",plugin_instance="foo-instance"} 1`,
+		"# TYPE vsphere_power_on_p95_seconds gauge",
+		`vsphere_power_on_p95_seconds{host="on-yes-host",plugin_instance="foo-instance"} 3`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, body)
+		}
+	}
+
+	if strings.Count(body, "# TYPE vsphere_power_on_success_total ") != 1 {
+		t.Errorf("expected exactly one TYPE line per metric, got:\n%s", body)
+	}
+}
@@ -0,0 +1,62 @@
+package collectdvsphere
+
+import (
+	"collectd.org/api"
+)
+
+// defaultRetryQueueSize is the number of value lists a CollectdWriter keeps to
+// retry, unless it's changed with SetRetryQueueSize.
+const defaultRetryQueueSize = 10000
+
+// A retryQueue holds value lists that couldn't be written, so they can be
+// written again later. Once the queue is full, the oldest value lists are
+// dropped to make room for new ones.
+type retryQueue struct {
+	maxSize    int
+	valueLists []api.ValueList
+	dropped    int64
+}
+
+// newRetryQueue returns a retryQueue that holds up to maxSize value lists. If
+// maxSize is negative, nothing is kept.
+func newRetryQueue(maxSize int) *retryQueue {
+	q := &retryQueue{}
+	q.setMaxSize(maxSize)
+	return q
+}
+
+// setMaxSize changes the number of value lists the queue holds, dropping the
+// oldest ones if there are more than that in the queue already. If maxSize is
+// negative, nothing is kept.
+func (q *retryQueue) setMaxSize(maxSize int) {
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	q.maxSize = maxSize
+	q.push()
+}
+
+// push adds value lists to the end of the queue, dropping the oldest ones if
+// the queue is full.
+func (q *retryQueue) push(valueLists ...api.ValueList) {
+	q.valueLists = append(q.valueLists, valueLists...)
+	if excess := len(q.valueLists) - q.maxSize; excess > 0 {
+		q.valueLists = append([]api.ValueList(nil), q.valueLists[excess:]...)
+		q.dropped += int64(excess)
+	}
+}
+
+// retry writes the queued value lists in order using the given function,
+// stopping at the first one that fails. The written value lists are removed
+// from the queue.
+func (q *retryQueue) retry(write func(api.ValueList) error) error {
+	for len(q.valueLists) > 0 {
+		err := write(q.valueLists[0])
+		if err != nil {
+			return err
+		}
+		q.valueLists = q.valueLists[1:]
+	}
+
+	return nil
+}
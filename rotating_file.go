@@ -0,0 +1,112 @@
+package collectdvsphere
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// A rotatingFile is a file that's appended to, and which is moved to a backup
+// (path.1, with older backups moved to path.2 and so on) once it grows past a
+// maximum size.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// newRotatingFile returns a rotatingFile at the given path. If maxSize is 0,
+// the file is never rotated.
+func newRotatingFile(path string, maxSize int64, maxBackups int) *rotatingFile {
+	return &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+// Write appends data to the file, rotating it first if the data would make it
+// grow past the maximum size.
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		return n, errors.Wrapf(err, "failed to write to %s", f.path)
+	}
+
+	return n, nil
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", f.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to stat %s", f.path)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	err := f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to close %s", f.path)
+	}
+
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(f.backupPath(i), f.backupPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "failed to move %s", f.backupPath(i))
+			}
+		}
+		err = os.Rename(f.path, f.backupPath(1))
+	} else {
+		err = os.Remove(f.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to rotate %s", f.path)
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
@@ -12,222 +12,691 @@ import (
 )
 
 // A StatsCollector stores various stats that are sent to it and allows you to fetch metrics based on them.
+//
+// The stats are kept in a registry of metric families, such as
+// "power_on_success" for hosts, which are tracked per entity. Counters are
+// increased with Increment and durations recorded with Observe, and new
+// families only have to be added to statsCollectorFamilies.
 type StatsCollector struct {
-	writer                 api.Writer
+	sinks                  []*metricSink
+	writeTimeout           time.Duration
 	interval               time.Duration
 	logger                 logrus.FieldLogger
 	collectdPluginInstance string
 
 	mutex sync.Mutex
 
+	// Signals the write loop that a family's interval changed.
+	reschedule chan struct{}
+
+	// Closed by Stop to end the write loop, and making sure it's only closed
+	// once.
+	stop     chan struct{}
+	stopOnce sync.Once
+
 	// Whether any new events have been received since the last write.
 	newEvents bool
 
-	// The time of the last time the events were written to the api.Writer.
+	// The time of the last time the events were written to the MetricWriter.
 	lastWrite time.Time
 
+	// The compute cluster and datacenter each entity is in, if known.
+	locations map[entityRef]entityLocation
+
+	// When entities that are no longer monitored, such as hosts that were
+	// removed from a cluster, stop being reported.
+	retirements map[entityRef]time.Time
+
+	registry *metricRegistry
+
+	// Path to the file the counters are saved in, if they're persisted, and
+	// a mutex held while saving them.
+	counterStatePath  string
+	counterStateMutex sync.Mutex
+
+	// The counters restored from the counter state file, which are given to
+	// sinks that are counterBaselineWriters.
+	counterBaseline []Metric
+
+	// Held while an event is counted and while the counters are copied to be
+	// saved, and the event checkpoint the counters include the events up to,
+	// and the one that was restored from the counter state file.
+	eventMutex         sync.Mutex
+	eventCheckpoint    *eventCheckpoint
+	restoredCheckpoint *eventCheckpointState
+}
+
+// statsCollectorFamilies are the metric families tracked by a StatsCollector.
+var statsCollectorFamilies = []struct {
+	entityKind string
+	name       string
+	kind       int
+}{
 	// Host stats
-	powerOnSuccess  map[string]int64
-	powerOnFailure  map[string]int64
-	powerOffSuccess map[string]int64
-	powerOffFailure map[string]int64
+	{EntityHost, "power_on_success", familyCounter},
+	{EntityHost, "power_on_failure", familyCounter},
+	{EntityHost, "power_off_success", familyCounter},
+	{EntityHost, "power_off_failure", familyCounter},
+	{EntityHost, "migrate_in", familyCounter},
+	{EntityHost, "migrate_out", familyCounter},
+	{EntityHost, "migrate_failure", familyCounter},
+	{EntityHost, "power_on", familyDuration},
+
+	// vCenter stats
+	{EntityVCenter, "reconnect", familyCounter},
 
 	// Base VM stats
-	cloneSuccess map[string]int64
-	cloneFailure map[string]int64
+	{EntityBaseVM, "clone_success", familyCounter},
+	{EntityBaseVM, "clone_failure", familyCounter},
+	{EntityBaseVM, "clone", familyDuration},
+
+	// Sink stats
+	{EntitySink, "write_success", familyCounter},
+	{EntitySink, "write_failure", familyCounter},
+	{EntitySink, "queue_length", familyGauge},
+	{EntitySink, "queue_dropped", familyCounter},
 }
 
 // NewStatsCollector returns a new StatsCollector with no stats, which writes
-// its stats to the given api.Writer every interval.
+// its stats to the given api.Writer every interval, through a CollectdWriter.
 func NewStatsCollector(writer api.Writer, interval time.Duration, logger logrus.FieldLogger, collectdPluginInstance string) *StatsCollector {
+	var metricWriter MetricWriter
+	if writer != nil {
+		metricWriter = NewCollectdWriter(writer)
+	}
+
+	return NewMetricStatsCollector(metricWriter, interval, logger, collectdPluginInstance)
+}
+
+// NewMetricStatsCollector returns a new StatsCollector with no stats, which
+// writes its stats to the given MetricWriter every interval, or at the interval
+// set for a metric family with SetFamilyInterval. The writer can be nil if the
+// stats are only read through Metrics or written to sinks added with AddSink.
+func NewMetricStatsCollector(writer MetricWriter, interval time.Duration, logger logrus.FieldLogger, collectdPluginInstance string) *StatsCollector {
+	collector := newStatsCollector(writer, interval, logger, collectdPluginInstance)
+
+	go collector.run()
+
+	return collector
+}
+
+// Stop stops writing the stats every interval. Stats that haven't been
+// written yet aren't written anymore.
+func (c *StatsCollector) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// run writes each metric family whenever it's due, until Stop is called.
+func (c *StatsCollector) run() {
+	for {
+		timer := time.NewTimer(c.untilNextWrite(time.Now()))
+		select {
+		case <-timer.C:
+		case <-c.reschedule:
+			timer.Stop()
+			continue
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+
+		err := c.writeDue(time.Now())
+		if err != nil {
+			c.logger.WithField("err", err).Info("failed writing metrics")
+			raven.CaptureError(err, nil)
+		}
+
+		err = c.SaveCounters()
+		if err != nil {
+			c.logger.WithField("err", err).Error("failed saving counters")
+		}
+	}
+}
+
+// newStatsCollector returns a new StatsCollector with no stats, which only
+// writes its stats when writeAt is called.
+func newStatsCollector(writer MetricWriter, interval time.Duration, logger logrus.FieldLogger, collectdPluginInstance string) *StatsCollector {
 	collector := &StatsCollector{
-		writer:                 writer,
+		writeTimeout:           defaultSinkWriteTimeout,
 		interval:               interval,
 		logger:                 logger,
 		collectdPluginInstance: collectdPluginInstance,
-		powerOnSuccess:         make(map[string]int64),
-		powerOnFailure:         make(map[string]int64),
-		powerOffSuccess:        make(map[string]int64),
-		powerOffFailure:        make(map[string]int64),
-		cloneSuccess:           make(map[string]int64),
-		cloneFailure:           make(map[string]int64),
-	}
-
-	go func(collector *StatsCollector) {
-		ticker := time.NewTicker(collector.interval)
-		for range ticker.C {
-			err := collector.writeToCollectd()
-			if err != nil {
-				collector.logger.WithField("err", err).Info("failed writing to collectd")
-				raven.CaptureError(err, nil)
-			}
-		}
-	}(collector)
+		locations:              make(map[entityRef]entityLocation),
+		retirements:            make(map[entityRef]time.Time),
+		registry:               newMetricRegistry(),
+		reschedule:             make(chan struct{}, 1),
+		stop:                   make(chan struct{}),
+	}
+
+	for _, family := range statsCollectorFamilies {
+		collector.registry.register(family.entityKind, family.name, family.kind)
+	}
+
+	if writer != nil {
+		collector.addSink("default", writer)
+	}
 
 	return collector
 }
 
-// MarkPowerOnSuccess increases the number of successful VM power-on events on a
-// host with a given hostname.
-func (c *StatsCollector) MarkPowerOnSuccess(hostname string) {
+// AddSink adds a MetricWriter that the stats are written to every interval,
+// in addition to the writer given to NewStatsCollector or
+// NewMetricStatsCollector. The name of the sink is used in logs and in the
+// metrics about the sink itself. Writing to each sink is independent of the
+// others, so a failing sink doesn't stop the metrics from being written to the
+// rest.
+func (c *StatsCollector) AddSink(name string, writer MetricWriter) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.ensureHostExists(hostname)
-	c.powerOnSuccess[hostname]++
-	c.newEvents = true
+	c.addSink(name, writer)
 }
 
-// MarkPowerOnFailure increases the number of failed VM power-on events on a
-// host with a given hostname.
-func (c *StatsCollector) MarkPowerOnFailure(hostname string) {
+func (c *StatsCollector) addSink(name string, writer MetricWriter) {
+	c.sinks = append(c.sinks, newMetricSink(name, writer))
+	c.registry.ensureEntity(EntitySink, name)
+
+	if baselineWriter, ok := writer.(counterBaselineWriter); ok && c.counterBaseline != nil {
+		baselineWriter.setCounterBaseline(c.counterBaseline)
+	}
+}
+
+// SetWriteTimeout sets how long to wait for a sink to accept the metrics of an
+// interval before giving up on it.
+func (c *StatsCollector) SetWriteTimeout(timeout time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeTimeout = timeout
+}
+
+// SetFamilyInterval makes the metric family with the given name, such as
+// "power_on_success", be written every interval instead of at the interval of
+// the StatsCollector. The interval is also used as the interval of the
+// family's collectd value lists.
+func (c *StatsCollector) SetFamilyInterval(name string, interval time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	family, ok := c.registry.byName[name]
+	if !ok {
+		return errors.Errorf("unknown metric family %s", name)
+	}
+	if interval <= 0 {
+		return errors.Errorf("interval for metric family %s must be positive, but was %s", name, interval)
+	}
+
+	family.interval = interval
+	family.nextWrite = time.Time{}
+
+	select {
+	case c.reschedule <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// familyInterval returns how often a metric family is written.
+func (c *StatsCollector) familyInterval(family *metricFamily) time.Duration {
+	if family.interval != 0 {
+		return family.interval
+	}
+
+	return c.interval
+}
+
+// Increment increases the counter of the metric family with the given name for
+// an entity, such as "power_on_success" for a host.
+func (c *StatsCollector) Increment(name, entity string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.ensureHostExists(hostname)
-	c.powerOnFailure[hostname]++
+	if !c.registry.increment(name, entity) {
+		c.logger.WithField("name", name).Error("tried to increment unknown counter")
+		return
+	}
+	c.keepEntity(name, entity)
 	c.newEvents = true
 }
 
-// MarkPowerOffSuccess increases the number of successful VM power-off events
-// on a host with a given hostname.
-func (c *StatsCollector) MarkPowerOffSuccess(hostname string) {
+// Observe records a duration in the metric family with the given name for an
+// entity, such as how long it took to power on a VM on a host in "power_on".
+func (c *StatsCollector) Observe(name, entity string, duration time.Duration) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.ensureHostExists(hostname)
-	c.powerOffSuccess[hostname]++
+	if !c.registry.observe(name, entity, duration) {
+		c.logger.WithField("name", name).Error("tried to observe unknown duration")
+		return
+	}
+	c.keepEntity(name, entity)
 	c.newEvents = true
 }
 
+// sinkList returns the sinks that the stats are written to.
+func (c *StatsCollector) sinkList() []*metricSink {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*metricSink(nil), c.sinks...)
+}
+
+// keepEntity cancels the retirement of an entity that something happened to in
+// the metric family with the given name, since it's evidently still around.
+// The mutex must be held while calling keepEntity.
+func (c *StatsCollector) keepEntity(name, entity string) {
+	family, ok := c.registry.byName[name]
+	if !ok {
+		return
+	}
+
+	delete(c.retirements, entityRef{family.entityKind, entity})
+}
+
+// MarkPowerOnSuccess increases the number of successful VM power-on events on a
+// host with a given hostname.
+func (c *StatsCollector) MarkPowerOnSuccess(hostname string) {
+	c.Increment("power_on_success", hostname)
+}
+
+// MarkPowerOnFailure increases the number of failed VM power-on events on a
+// host with a given hostname.
+func (c *StatsCollector) MarkPowerOnFailure(hostname string) {
+	c.Increment("power_on_failure", hostname)
+}
+
+// MarkPowerOffSuccess increases the number of successful VM power-off events
+// on a host with a given hostname.
+func (c *StatsCollector) MarkPowerOffSuccess(hostname string) {
+	c.Increment("power_off_success", hostname)
+}
+
 // MarkPowerOffFailure increases the number of failed VM power-off events on a
 // host with a given hostname.
 func (c *StatsCollector) MarkPowerOffFailure(hostname string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.Increment("power_off_failure", hostname)
+}
 
-	c.ensureHostExists(hostname)
-	c.powerOffFailure[hostname]++
-	c.newEvents = true
+// MarkMigrateIn increases the number of VMs migrated onto a host with a given
+// hostname.
+func (c *StatsCollector) MarkMigrateIn(hostname string) {
+	c.Increment("migrate_in", hostname)
+}
+
+// MarkMigrateOut increases the number of VMs migrated away from a host with a
+// given hostname.
+func (c *StatsCollector) MarkMigrateOut(hostname string) {
+	c.Increment("migrate_out", hostname)
+}
+
+// MarkMigrateFailure increases the number of failed VM migrations away from a
+// host with a given hostname.
+func (c *StatsCollector) MarkMigrateFailure(hostname string) {
+	c.Increment("migrate_failure", hostname)
+}
+
+// ObservePowerOnDuration records how long it took to power on a VM on a host
+// with a given hostname.
+func (c *StatsCollector) ObservePowerOnDuration(hostname string, duration time.Duration) {
+	c.Observe("power_on", hostname, duration)
+}
+
+// MarkReconnect increases the number of times the connection to the vSphere
+// API with a given hostname had to be re-established.
+func (c *StatsCollector) MarkReconnect(vCenterName string) {
+	c.Increment("reconnect", vCenterName)
 }
 
 // MarkCloneSuccess increases the number of successful clones of a base VM with
 // a given name.
 func (c *StatsCollector) MarkCloneSuccess(baseVMName string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	c.ensureBaseVMExists(baseVMName)
-	c.cloneSuccess[baseVMName]++
-	c.newEvents = true
+	c.Increment("clone_success", baseVMName)
 }
 
 // MarkCloneFailure increases the number of failed clones of a base VM with a
 // given name.
 func (c *StatsCollector) MarkCloneFailure(baseVMName string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.Increment("clone_failure", baseVMName)
+}
 
-	c.ensureBaseVMExists(baseVMName)
-	c.cloneFailure[baseVMName]++
-	c.newEvents = true
+// ObserveCloneDuration records how long a clone of a base VM with a given name
+// took.
+func (c *StatsCollector) ObserveCloneDuration(baseVMName string, duration time.Duration) {
+	c.Observe("clone", baseVMName, duration)
 }
 
 func (c *StatsCollector) writeToCollectd() error {
+	return c.writeAt(time.Now())
+}
+
+// untilNextWrite returns how long it is until the next metric family is due
+// to be written.
+func (c *StatsCollector) untilNextWrite(now time.Time) time.Duration {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if !c.newEvents {
-		return nil
+	var next time.Time
+	for _, family := range c.registry.families {
+		if family.nextWrite.IsZero() {
+			family.nextWrite = now.Add(c.familyInterval(family))
+		}
+		if next.IsZero() || family.nextWrite.Before(next) {
+			next = family.nextWrite
+		}
 	}
 
-	statTime := time.Now()
-	c.lastWrite = statTime
+	return next.Sub(now)
+}
 
-	events := 0
+// writeDue writes the metric families that are due to be written at the given
+// time.
+func (c *StatsCollector) writeDue(now time.Time) error {
+	c.mutex.Lock()
+	var due []*metricFamily
+	for _, family := range c.registry.families {
+		if family.nextWrite.IsZero() || now.Before(family.nextWrite) {
+			continue
+		}
 
-	for host, stat := range c.powerOnSuccess {
-		events++
-		err := c.writer.Write(c.makeValueList(host, "power_on_success", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write power_on_success metric")
+		due = append(due, family)
+		for !family.nextWrite.After(now) {
+			family.nextWrite = family.nextWrite.Add(c.familyInterval(family))
 		}
 	}
-	for host, stat := range c.powerOnFailure {
-		events++
-		err := c.writer.Write(c.makeValueList(host, "power_on_failure", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write power_on_failure metric")
-		}
+	snapshot := c.snapshot(due, now)
+	c.mutex.Unlock()
+
+	return c.writeSnapshot(snapshot)
+}
+
+// writeAt writes every metric family to every sink with the given time as
+// their timestamp, regardless of the intervals of the families.
+func (c *StatsCollector) writeAt(statTime time.Time) error {
+	c.mutex.Lock()
+	snapshot := c.snapshot(c.registry.families, statTime)
+	c.mutex.Unlock()
+
+	return c.writeSnapshot(snapshot)
+}
+
+// A metricsSnapshot is a consistent copy of the metrics to write at the end of
+// an interval, along with the sinks to write them to.
+type metricsSnapshot struct {
+	metrics []Metric
+	sinks   []*metricSink
+	timeout time.Duration
+}
+
+// snapshot ends the current interval of the given metric families and returns
+// their metrics with the given time as their timestamp. It returns nil if
+// there's nothing to write. The mutex must be held while calling snapshot.
+func (c *StatsCollector) snapshot(families []*metricFamily, statTime time.Time) *metricsSnapshot {
+	c.removeRetiredEntities(statTime)
+
+	if !c.newEvents || len(families) == 0 {
+		return nil
 	}
-	for host, stat := range c.powerOffSuccess {
-		events++
-		err := c.writer.Write(c.makeValueList(host, "power_off_success", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write power_off_success metric")
+
+	c.lastWrite = statTime
+	for _, family := range families {
+		for _, stats := range family.durations {
+			stats.summarizeInterval()
 		}
 	}
-	for host, stat := range c.powerOffFailure {
-		events++
-		err := c.writer.Write(c.makeValueList(host, "power_off_failure", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write power_off_failure metric")
-		}
+
+	if len(c.sinks) == 0 {
+		return nil
 	}
-	for baseVM, stat := range c.cloneSuccess {
-		events++
-		err := c.writer.Write(c.makeValueList(baseVM, "clone_success", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write clone_success metric")
+
+	return &metricsSnapshot{
+		metrics: c.metrics(families, statTime),
+		sinks:   append([]*metricSink(nil), c.sinks...),
+		timeout: c.writeTimeout,
+	}
+}
+
+// writeSnapshot writes a snapshot to all of its sinks at the same time,
+// without holding the mutex, so that a slow sink doesn't hold up the handling
+// of events or the other sinks. If writing to any of the sinks fails, the
+// metrics are still written to the others, and a sinkErrors is returned.
+func (c *StatsCollector) writeSnapshot(snapshot *metricsSnapshot) error {
+	if snapshot == nil {
+		return nil
+	}
+
+	sinkErrs := make([]error, len(snapshot.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range snapshot.sinks {
+		wg.Add(1)
+		go func(i int, sink *metricSink) {
+			defer wg.Done()
+			sinkErrs[i] = sink.write(snapshot.metrics, snapshot.timeout)
+		}(i, sink)
+	}
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var errs sinkErrors
+	for i, sink := range snapshot.sinks {
+		if sinkErrs[i] != nil {
+			c.registry.increment("write_failure", sink.name)
+			errs = append(errs, sinkErrs[i])
+			continue
 		}
+		c.registry.increment("write_success", sink.name)
+
+		c.logger.WithFields(logrus.Fields{
+			"sink":        sink.name,
+			"event_count": len(snapshot.metrics),
+		}).Info("sent metrics")
 	}
-	for baseVM, stat := range c.cloneFailure {
-		events++
-		err := c.writer.Write(c.makeValueList(baseVM, "clone_failure", statTime, stat))
-		if err != nil {
-			return errors.Wrap(err, "failed to write clone_failure metric")
+
+	for _, sink := range snapshot.sinks {
+		if writer, ok := sink.writer.(queueingMetricWriter); ok {
+			length, dropped := writer.queueStats()
+			c.registry.setGauge("queue_length", sink.name, float64(length))
+			c.registry.add("queue_dropped", sink.name, dropped)
 		}
 	}
 
-	c.logger.WithField("event_count", events).Info("sent metrics to collectd")
+	if len(errs) > 0 {
+		return errs
+	}
 
 	return nil
 }
 
-func (c *StatsCollector) makeValueList(host, metric string, statTime time.Time, value int64) api.ValueList {
-	var valueList api.ValueList
-	valueList.Identifier.Host = host
-	valueList.Identifier.Plugin = "vsphere"
-	valueList.Identifier.PluginInstance = c.collectdPluginInstance
-	valueList.Identifier.Type = "operations"
-	valueList.Identifier.TypeInstance = metric
-	valueList.Time = statTime
-	valueList.Interval = c.interval
-	valueList.Values = []api.Value{api.Derive(value)}
+// Metrics returns the current value of every metric. The duration metrics
+// describe the durations observed in the last complete interval.
+func (c *StatsCollector) Metrics() []Metric {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.removeRetiredEntities(now)
+
+	return c.metrics(c.registry.families, now)
+}
+
+func (c *StatsCollector) metrics(families []*metricFamily, statTime time.Time) []Metric {
+	var metrics []Metric
+	for _, family := range families {
+		for entity, value := range family.counters {
+			metrics = append(metrics, c.makeMetric(family, entity, "operations", family.name, statTime, api.Derive(value)))
+		}
+		for entity, stats := range family.durations {
+			if stats.lastInterval.count == 0 {
+				continue
+			}
+			metrics = append(metrics, c.makeDurationMetrics(family, entity, statTime, stats.lastInterval)...)
+		}
+		for entity, value := range family.gauges {
+			metrics = append(metrics, c.makeMetric(family, entity, "gauge", family.name, statTime, api.Gauge(value)))
+		}
+	}
 
-	return valueList
+	return metrics
 }
 
-func (c *StatsCollector) ensureHostExists(hostname string) {
-	if _, ok := c.powerOnSuccess[hostname]; !ok {
-		c.powerOnSuccess[hostname] = 0
+// makeDurationMetrics returns the min, avg, max and percentile durations of a
+// summary as gauges in seconds, with the family name as a prefix of their
+// names.
+func (c *StatsCollector) makeDurationMetrics(family *metricFamily, entity string, statTime time.Time, summary durationSummary) []Metric {
+	values := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"min", summary.min},
+		{"avg", summary.avg},
+		{"max", summary.max},
+		{"p50", summary.p50},
+		{"p95", summary.p95},
+		{"p99", summary.p99},
+	}
+
+	metrics := make([]Metric, 0, len(values))
+	for _, value := range values {
+		metrics = append(metrics, c.makeMetric(family, entity, "duration", family.name+"_"+value.name, statTime, api.Gauge(value.duration.Seconds())))
+	}
+
+	return metrics
+}
+
+func (c *StatsCollector) makeMetric(family *metricFamily, entity, typ, name string, statTime time.Time, value api.Value) Metric {
+	location := c.locations[entityRef{family.entityKind, entity}]
+
+	return Metric{
+		EntityKind:     family.entityKind,
+		Entity:         entity,
+		Cluster:        location.cluster,
+		Datacenter:     location.datacenter,
+		Type:           typ,
+		Name:           name,
+		PluginInstance: c.collectdPluginInstance,
+		Time:           statTime,
+		Interval:       c.familyInterval(family),
+		Value:          value,
 	}
-	if _, ok := c.powerOnFailure[hostname]; !ok {
-		c.powerOnFailure[hostname] = 0
+}
+
+// An entityRef identifies an entity by its kind and name.
+type entityRef struct {
+	kind string
+	name string
+}
+
+// An entityLocation is the compute cluster and datacenter an entity is in.
+type entityLocation struct {
+	cluster    string
+	datacenter string
+}
+
+// setLocation records the names of the compute cluster and datacenter an
+// entity is in. Empty names don't replace names that are already known.
+func (c *StatsCollector) setLocation(entityKind, entity, cluster, datacenter string) {
+	if entity == unattributedEntity || (cluster == "" && datacenter == "") {
+		return
 	}
-	if _, ok := c.powerOffSuccess[hostname]; !ok {
-		c.powerOffSuccess[hostname] = 0
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ref := entityRef{entityKind, entity}
+	location := c.locations[ref]
+	if cluster != "" {
+		location.cluster = cluster
 	}
-	if _, ok := c.powerOffFailure[hostname]; !ok {
-		c.powerOffFailure[hostname] = 0
+	if datacenter != "" {
+		location.datacenter = datacenter
 	}
+	c.locations[ref] = location
+}
+
+// ensureHostExists adds a host to every host metric family, so that its
+// series are reported even before anything has happened on it.
+func (c *StatsCollector) ensureHostExists(hostname string) {
+	c.ensureEntityExists(EntityHost, hostname)
+}
+
+// ensureVCenterExists adds a vCenter to every vCenter metric family.
+func (c *StatsCollector) ensureVCenterExists(vCenterName string) {
+	c.ensureEntityExists(EntityVCenter, vCenterName)
 }
 
+// ensureBaseVMExists adds a base VM to every base VM metric family.
 func (c *StatsCollector) ensureBaseVMExists(baseVMName string) {
-	if _, ok := c.cloneSuccess[baseVMName]; !ok {
-		c.cloneSuccess[baseVMName] = 0
+	c.ensureEntityExists(EntityBaseVM, baseVMName)
+}
+
+// ensureEntityExists adds an entity to every metric family for its kind of
+// entity, and cancels its retirement if it was going to be retired.
+func (c *StatsCollector) ensureEntityExists(entityKind, entity string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.registry.ensureEntity(entityKind, entity)
+	delete(c.retirements, entityRef{entityKind, entity})
+}
+
+// retireEntity stops reporting an entity once the given time has passed,
+// unless it's added again with ensureEntityExists or something happens to it
+// before then. The time an
+// entity is retired at isn't moved back by retiring it again.
+func (c *StatsCollector) retireEntity(entityKind, entity string, at time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ref := entityRef{entityKind, entity}
+	if _, ok := c.retirements[ref]; ok {
+		return
+	}
+	c.retirements[ref] = at
+}
+
+// retireMissingEntities retires every entity of a kind that isn't in present,
+// other than the unattributed entity, at the given time. It returns the names
+// of the entities that weren't already being retired.
+func (c *StatsCollector) retireMissingEntities(entityKind string, present map[string]bool, at time.Time) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var retired []string
+	for _, entity := range c.registry.entities(entityKind) {
+		if present[entity] || entity == unattributedEntity {
+			continue
+		}
+
+		ref := entityRef{entityKind, entity}
+		if _, ok := c.retirements[ref]; ok {
+			continue
+		}
+		c.retirements[ref] = at
+		retired = append(retired, entity)
 	}
-	if _, ok := c.cloneFailure[baseVMName]; !ok {
-		c.cloneFailure[baseVMName] = 0
+
+	return retired
+}
+
+// removeRetiredEntities removes the entities whose time to be retired has
+// passed. The mutex must be held while calling removeRetiredEntities.
+func (c *StatsCollector) removeRetiredEntities(now time.Time) {
+	for ref, at := range c.retirements {
+		if now.Before(at) {
+			continue
+		}
+
+		c.registry.removeEntity(ref.kind, ref.name)
+		delete(c.locations, ref)
+		delete(c.retirements, ref)
+
+		c.logger.WithFields(logrus.Fields{
+			"entity_kind": ref.kind,
+			"entity":      ref.name,
+		}).Info("stopped reporting retired entity")
 	}
 }
@@ -1,6 +1,7 @@
 package collectdvsphere
 
 import (
+	"errors"
 	"io/ioutil"
 	"sync"
 	"testing"
@@ -32,29 +33,61 @@ func (w *fakeAPIWriter) Write(vl api.ValueList) error {
 	return nil
 }
 
+// expectedMetric is the value a metric, given by its collectd identifier, is
+// expected to have been written with.
+type expectedMetric struct {
+	metric string
+	value  api.Value
+}
+
+// checkMetrics checks that the expected metrics were written to the
+// fakeAPIWriter with the expected values.
+func (w *fakeAPIWriter) checkMetrics(t *testing.T, expectedMetrics []expectedMetric) {
+	t.Helper()
+
+	for _, expected := range expectedMetrics {
+		actualValue := w.readMetric(expected.metric)
+		if actualValue != expected.value {
+			t.Errorf("expected %s to be %+v, but was %+v", expected.metric, expected.value, actualValue)
+		}
+	}
+}
+
+// newNullLogger returns a logger that discards everything logged to it.
+func newNullLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
 func TestStatsCollector(t *testing.T) {
 	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
 
-	nullLogger := logrus.New()
-	nullLogger.Out = ioutil.Discard
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
 
-	collector := NewStatsCollector(apiWriter, time.Millisecond, nullLogger, "foo-instance")
 	collector.MarkPowerOnSuccess("on-yes-host")
 	collector.MarkPowerOnSuccess("on-yes-host")
 	collector.MarkPowerOnFailure("on-no-host")
 	collector.MarkPowerOffSuccess("off-yes-host")
 	collector.MarkPowerOffFailure("off-no-host")
+	collector.MarkMigrateIn("migrate-in-host")
+	collector.MarkMigrateOut("migrate-out-host")
+	collector.MarkMigrateFailure("migrate-out-host")
+	collector.MarkReconnect("vcenter")
 	collector.MarkCloneSuccess("yes-image")
 	collector.MarkCloneFailure("no-image")
+	collector.ObserveCloneDuration("yes-image", 2*time.Second)
+	collector.ObserveCloneDuration("yes-image", 4*time.Second)
 
-	// Sleep for 2 milliseconds to allow the metrics to be written to the
-	// fakeAPIWriter.
-	time.Sleep(2 * time.Millisecond)
+	err := collector.writeAt(time.Now())
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
 
-	expectedMetrics := []struct {
-		metric string
-		value  api.Value
-	}{
+	expectedMetrics := []expectedMetric{
 		{"on-yes-host/vsphere-foo-instance/operations-power_on_success", api.Derive(2)},
 		{"on-yes-host/vsphere-foo-instance/operations-power_on_failure", api.Derive(0)},
 		{"on-yes-host/vsphere-foo-instance/operations-power_off_success", api.Derive(0)},
@@ -75,17 +108,177 @@ func TestStatsCollector(t *testing.T) {
 		{"off-no-host/vsphere-foo-instance/operations-power_off_success", api.Derive(0)},
 		{"off-no-host/vsphere-foo-instance/operations-power_off_failure", api.Derive(1)},
 
+		{"migrate-in-host/vsphere-foo-instance/operations-migrate_in", api.Derive(1)},
+		{"migrate-in-host/vsphere-foo-instance/operations-migrate_out", api.Derive(0)},
+		{"migrate-in-host/vsphere-foo-instance/operations-migrate_failure", api.Derive(0)},
+		{"migrate-in-host/vsphere-foo-instance/operations-power_on_success", api.Derive(0)},
+
+		{"migrate-out-host/vsphere-foo-instance/operations-migrate_in", api.Derive(0)},
+		{"migrate-out-host/vsphere-foo-instance/operations-migrate_out", api.Derive(1)},
+		{"migrate-out-host/vsphere-foo-instance/operations-migrate_failure", api.Derive(1)},
+
+		{"vcenter/vsphere-foo-instance/operations-reconnect", api.Derive(1)},
+
 		{"yes-image/vsphere-foo-instance/operations-clone_success", api.Derive(1)},
 		{"yes-image/vsphere-foo-instance/operations-clone_failure", api.Derive(0)},
+		{"yes-image/vsphere-foo-instance/duration-clone_min", api.Gauge(2)},
+		{"yes-image/vsphere-foo-instance/duration-clone_avg", api.Gauge(3)},
+		{"yes-image/vsphere-foo-instance/duration-clone_max", api.Gauge(4)},
+		{"yes-image/vsphere-foo-instance/duration-clone_p50", api.Gauge(2)},
+		{"yes-image/vsphere-foo-instance/duration-clone_p99", api.Gauge(4)},
 
 		{"no-image/vsphere-foo-instance/operations-clone_success", api.Derive(0)},
 		{"no-image/vsphere-foo-instance/operations-clone_failure", api.Derive(1)},
 	}
 
-	for _, expected := range expectedMetrics {
-		actualValue := apiWriter.readMetric(expected.metric)
-		if actualValue != expected.value {
-			t.Errorf("expected %s to be %+v, but was %+v", expected.metric, expected.value, actualValue)
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+type failingMetricWriter struct{}
+
+func (w failingMetricWriter) WriteMetrics(metrics []Metric) error {
+	return errors.New("sink is broken")
+}
+
+func TestStatsCollectorSinkFailure(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	collector.AddSink("broken", failingMetricWriter{})
+	collector.AddSink("collectd", NewCollectdWriter(apiWriter))
+	collector.MarkPowerOnSuccess("on-yes-host")
+
+	err := collector.writeToCollectd()
+	if err == nil {
+		t.Error("expected an error from the broken sink")
+	}
+
+	collector.MarkPowerOnSuccess("on-yes-host")
+	err = collector.writeToCollectd()
+	if err == nil {
+		t.Error("expected an error from the broken sink")
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"on-yes-host/vsphere-foo-instance/operations-power_on_success", api.Derive(2)},
+		{"broken/vsphere-foo-instance/operations-write_success", api.Derive(0)},
+		{"broken/vsphere-foo-instance/operations-write_failure", api.Derive(1)},
+		{"collectd/vsphere-foo-instance/operations-write_success", api.Derive(1)},
+		{"collectd/vsphere-foo-instance/operations-write_failure", api.Derive(0)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+type fakeMetricWriter struct {
+	metrics []Metric
+}
+
+func (w *fakeMetricWriter) WriteMetrics(metrics []Metric) error {
+	w.metrics = append(w.metrics, metrics...)
+	return nil
+}
+
+func TestStatsCollectorFamilyIntervals(t *testing.T) {
+	writer := &fakeMetricWriter{}
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(writer, time.Minute, nullLogger, "foo-instance")
+	err := collector.SetFamilyInterval("power_on_success", 10*time.Second)
+	if err != nil {
+		t.Fatalf("SetFamilyInterval returned error: %v", err)
+	}
+	if collector.SetFamilyInterval("no_such_family", time.Second) == nil {
+		t.Error("expected an error setting the interval of an unknown family")
+	}
+
+	collector.MarkPowerOnSuccess("on-yes-host")
+	collector.MarkReconnect("vcenter")
+
+	now := time.Date(2017, 1, 2, 3, 4, 0, 0, time.UTC)
+	if wait := collector.untilNextWrite(now); wait != 10*time.Second {
+		t.Errorf("expected the next write to be in 10s, but was in %s", wait)
+	}
+
+	err = collector.writeDue(now.Add(10 * time.Second))
+	if err != nil {
+		t.Fatalf("writeDue returned error: %v", err)
+	}
+
+	for _, metric := range writer.metrics {
+		if metric.Name == "reconnect" {
+			t.Errorf("expected reconnect not to be written after 10s")
+		}
+		if metric.Name == "power_on_success" && metric.Interval != 10*time.Second {
+			t.Errorf("expected power_on_success to have a 10s interval, but was %s", metric.Interval)
+		}
+	}
+	if len(writer.metrics) == 0 {
+		t.Fatal("expected power_on_success to be written after 10s")
+	}
+
+	writer.metrics = nil
+	err = collector.writeDue(now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("writeDue returned error: %v", err)
+	}
+
+	var wroteReconnect bool
+	for _, metric := range writer.metrics {
+		if metric.Name == "reconnect" {
+			wroteReconnect = metric.Interval == time.Minute
+		}
+	}
+	if !wroteReconnect {
+		t.Errorf("expected reconnect to be written with a 1m interval after 1m, got %+v", writer.metrics)
+	}
+}
+
+type blockingMetricWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingMetricWriter) WriteMetrics(metrics []Metric) error {
+	<-w.unblock
+	return nil
+}
+
+func TestStatsCollectorSlowSink(t *testing.T) {
+	writer := &blockingMetricWriter{unblock: make(chan struct{})}
+	defer close(writer.unblock)
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(writer, time.Minute, nullLogger, "foo-instance")
+	collector.SetWriteTimeout(10 * time.Millisecond)
+	collector.MarkPowerOnSuccess("on-yes-host")
+
+	errs := make(chan error)
+	go func() {
+		errs <- collector.writeToCollectd()
+	}()
+
+	// Events have to be handled while the sink is being written to.
+	marked := make(chan struct{})
+	go func() {
+		collector.MarkPowerOnSuccess("on-yes-host")
+		close(marked)
+	}()
+	select {
+	case <-marked:
+	case <-time.After(time.Second):
+		t.Fatal("expected MarkPowerOnSuccess not to block on a slow sink")
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected an error from the slow sink timing out")
 		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the write to time out")
 	}
 }
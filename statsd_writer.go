@@ -0,0 +1,181 @@
+package collectdvsphere
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"collectd.org/api"
+	"github.com/pkg/errors"
+)
+
+// statsDMaxPacketSize is the largest UDP packet a StatsDWriter sends, chosen to
+// fit in the MTU of most networks.
+const statsDMaxPacketSize = 1432
+
+// A StatsDWriter is a MetricWriter that sends the operation counters to a
+// StatsD or DogStatsD agent over UDP. Since StatsD counters are increments, the
+// difference from the previously written value of each counter is sent, and
+// counters that haven't changed aren't sent at all. A counter that's lower than
+// its previous value, such as one whose entity was retired and added again, is
+// taken to have started over from zero. The entity, its cluster
+// and datacenter if they're known, and the plugin instance are sent as
+// DogStatsD tags. Durations aren't sent.
+type StatsDWriter struct {
+	conn   net.Conn
+	prefix string
+
+	mutex sync.Mutex
+
+	// The last value of each counter that was sent.
+	lastValues map[statsDCounterKey]int64
+}
+
+// NewStatsDWriter returns a StatsDWriter that sends metrics to the StatsD agent
+// at the given host:port, with names starting with the given prefix followed
+// by a dot.
+func NewStatsDWriter(address, prefix string) (*StatsDWriter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to statsd at %s", address)
+	}
+
+	return &StatsDWriter{
+		conn:       conn,
+		prefix:     prefix,
+		lastValues: make(map[statsDCounterKey]int64),
+	}, nil
+}
+
+type statsDCounter struct {
+	key   statsDCounterKey
+	value int64
+}
+
+// A statsDCounterKey is what a counter's last value is kept under. The cluster
+// and datacenter aren't part of it, so that a counter continues from its last
+// value when its location becomes known or changes.
+type statsDCounterKey struct {
+	name           string
+	entityKind     string
+	entity         string
+	pluginInstance string
+}
+
+func newStatsDCounterKey(metric Metric) statsDCounterKey {
+	return statsDCounterKey{
+		name:           metric.Name,
+		entityKind:     metric.EntityKind,
+		entity:         metric.Entity,
+		pluginInstance: metric.PluginInstance,
+	}
+}
+
+// setCounterBaseline records the values of restored counters as sent, so
+// that only what they increase by from then on is sent.
+func (w *StatsDWriter) setCounterBaseline(metrics []Metric) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, metric := range metrics {
+		if value, ok := metric.Value.(api.Derive); ok {
+			w.lastValues[newStatsDCounterKey(metric)] = int64(value)
+		}
+	}
+}
+
+func (w *StatsDWriter) WriteMetrics(metrics []Metric) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var packet bytes.Buffer
+	var pending []statsDCounter
+	written := make(map[statsDCounterKey]bool)
+	writtenNames := make(map[string]bool)
+
+	for _, metric := range metrics {
+		value, ok := metric.Value.(api.Derive)
+		if !ok {
+			continue
+		}
+
+		name := w.prefix + "." + metric.Name
+		tags := fmt.Sprintf("%s:%s", metric.EntityKind, statsDTagValue(metric.Entity))
+		if metric.Cluster != "" {
+			tags += ",cluster:" + statsDTagValue(metric.Cluster)
+		}
+		if metric.Datacenter != "" {
+			tags += ",datacenter:" + statsDTagValue(metric.Datacenter)
+		}
+		tags += ",plugin_instance:" + statsDTagValue(metric.PluginInstance)
+		key := newStatsDCounterKey(metric)
+		written[key] = true
+		writtenNames[metric.Name] = true
+
+		delta := int64(value) - w.lastValues[key]
+		if delta < 0 {
+			// The counter started over, such as when its entity was retired
+			// and then added again.
+			delta = int64(value)
+		}
+		if delta == 0 {
+			w.lastValues[key] = int64(value)
+			continue
+		}
+
+		line := fmt.Sprintf("%s:%d|c|#%s", name, delta, tags)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsDMaxPacketSize {
+			err := w.send(&packet, pending)
+			if err != nil {
+				return err
+			}
+			pending = nil
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		pending = append(pending, statsDCounter{key: key, value: int64(value)})
+	}
+
+	// The counters of retired entities aren't written anymore, so their last
+	// values are forgotten. Only the counters written this time are known to
+	// be complete, since metric families can be written at different
+	// intervals.
+	for key := range w.lastValues {
+		if writtenNames[key.name] && !written[key] {
+			delete(w.lastValues, key)
+		}
+	}
+
+	if packet.Len() > 0 {
+		return w.send(&packet, pending)
+	}
+
+	return nil
+}
+
+// send writes a packet to the agent, and records the counter values in it as
+// sent if that succeeds.
+func (w *StatsDWriter) send(packet *bytes.Buffer, counters []statsDCounter) error {
+	_, err := w.conn.Write(packet.Bytes())
+	packet.Reset()
+	if err != nil {
+		return errors.Wrap(err, "failed to write metrics to statsd")
+	}
+
+	for _, counter := range counters {
+		w.lastValues[counter.key] = counter.value
+	}
+
+	return nil
+}
+
+// statsDTagValue replaces the characters that have a special meaning in the
+// DogStatsD protocol in a tag value.
+func statsDTagValue(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(value)
+}
@@ -0,0 +1,95 @@
+package collectdvsphere
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestStatsDWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	writer, err := NewStatsDWriter(conn.LocalAddr().String(), "vsphere")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	readPacket := func() string {
+		buf := make([]byte, statsDMaxPacketSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	metrics := []Metric{
+		{EntityKind: EntityHost, Entity: "host-1", Name: "power_on_success", PluginInstance: "foo-instance", Value: api.Derive(3)},
+		{EntityKind: EntityHost, Entity: "host-1", Name: "power_on_failure", PluginInstance: "foo-instance", Value: api.Derive(0)},
+		{EntityKind: EntityBaseVM, Entity: "image,1", Name: "clone_success", PluginInstance: "foo-instance", Value: api.Derive(1)},
+		{EntityKind: EntityBaseVM, Entity: "image,1", Name: "clone_p95", PluginInstance: "foo-instance", Value: api.Gauge(2)},
+	}
+	err = writer.WriteMetrics(metrics)
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected := "vsphere.power_on_success:3|c|#host:host-1,plugin_instance:foo-instance\n" +
+		"vsphere.clone_success:1|c|#base_vm:image_1,plugin_instance:foo-instance"
+	if packet := readPacket(); packet != expected {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+
+	metrics[0].Value = api.Derive(5)
+	err = writer.WriteMetrics(metrics)
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected = "vsphere.power_on_success:2|c|#host:host-1,plugin_instance:foo-instance"
+	if packet := readPacket(); packet != expected {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+
+	// A counter that went down started over, so its whole value is sent.
+	metrics[0].Value = api.Derive(1)
+	err = writer.WriteMetrics(metrics)
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected = "vsphere.power_on_success:1|c|#host:host-1,plugin_instance:foo-instance"
+	if packet := readPacket(); packet != expected {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+
+	// The counters of a retired host are forgotten once its metric families
+	// are written without it.
+	err = writer.WriteMetrics([]Metric{
+		{EntityKind: EntityHost, Entity: "host-2", Name: "power_on_success", PluginInstance: "foo-instance", Value: api.Derive(1)},
+		{EntityKind: EntityHost, Entity: "host-2", Name: "power_on_failure", PluginInstance: "foo-instance", Value: api.Derive(0)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+
+	expected = "vsphere.power_on_success:1|c|#host:host-2,plugin_instance:foo-instance"
+	if packet := readPacket(); packet != expected {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+	for key := range writer.lastValues {
+		if key.entity == "host-1" {
+			t.Errorf("expected %s of host-1 to be forgotten", key.name)
+		}
+	}
+	if _, ok := writer.lastValues[newStatsDCounterKey(metrics[2])]; !ok {
+		t.Error("expected clone_success of image,1 to be kept, since it wasn't written")
+	}
+}
@@ -0,0 +1,245 @@
+package collectdvsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// taggingRequestTimeout is how long a taggingClient waits for a response to
+// each request.
+const taggingRequestTimeout = 30 * time.Second
+
+// taggingIdleConnTimeout is how long a taggingClient keeps an idle connection
+// open. Tags are only looked up every rescan, so connections aren't kept
+// between rescans.
+const taggingIdleConnTimeout = 30 * time.Second
+
+// A taggingClient looks up which objects have a vSphere tag using the tagging
+// REST API of vCenter, which isn't available through the SOAP API used for
+// everything else. The IDs of tags are cached, since finding them by name
+// means getting every tag.
+type taggingClient struct {
+	baseURL   string
+	user      *url.Userinfo
+	client    *http.Client
+	transport *http.Transport
+	sessionID string
+
+	tagIDsByName map[string]string
+}
+
+// newTaggingClient returns a taggingClient for the vCenter with the given
+// vSphere API URL, logging in with the credentials in that URL.
+func newTaggingClient(vSphereURL *url.URL, insecure bool) *taggingClient {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		IdleConnTimeout: taggingIdleConnTimeout,
+	}
+
+	return &taggingClient{
+		baseURL: (&url.URL{Scheme: vSphereURL.Scheme, Host: vSphereURL.Host, Path: "/rest"}).String(),
+		user:    vSphereURL.User,
+		client: &http.Client{
+			Timeout:   taggingRequestTimeout,
+			Transport: transport,
+		},
+		transport:    transport,
+		tagIDsByName: make(map[string]string),
+	}
+}
+
+// login creates a session, which is used for every request after it.
+func (c *taggingClient) login(ctx context.Context) error {
+	req, err := http.NewRequest("POST", c.baseURL+"/com/vmware/cis/session", nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create tagging session request")
+	}
+	if c.user != nil {
+		password, _ := c.user.Password()
+		req.SetBasicAuth(c.user.Username(), password)
+	}
+
+	var sessionID string
+	err = c.do(ctx, req, &sessionID)
+	if err != nil {
+		return errors.Wrap(err, "failed to create tagging session")
+	}
+
+	c.sessionID = sessionID
+	return nil
+}
+
+// logout deletes the session created by login, and closes the connections
+// that are left open. Errors are ignored, since the session expires on its
+// own.
+func (c *taggingClient) logout(ctx context.Context) {
+	if c.sessionID == "" {
+		return
+	}
+
+	req, err := http.NewRequest("DELETE", c.baseURL+"/com/vmware/cis/session", nil)
+	if err == nil {
+		_ = c.do(ctx, req, nil)
+	}
+	c.sessionID = ""
+	c.transport.CloseIdleConnections()
+}
+
+// tagIDs returns the IDs of the tags with the given names. The tags are only
+// looked up if their IDs aren't cached yet. It returns an error naming every
+// tag that doesn't exist.
+func (c *taggingClient) tagIDs(ctx context.Context, names []string) ([]string, error) {
+	var uncached []string
+	for _, name := range names {
+		if _, ok := c.tagIDsByName[name]; !ok {
+			uncached = append(uncached, name)
+		}
+	}
+
+	if len(uncached) > 0 {
+		err := c.lookUpTags(ctx, uncached)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids, missing []string
+	for _, name := range names {
+		id, ok := c.tagIDsByName[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.Errorf("failed to find tags %s", strings.Join(missing, ", "))
+	}
+
+	return ids, nil
+}
+
+// lookUpTags caches the IDs of the tags with the given names. There's no way
+// to find a tag by name, so every tag is listed and then got until all of the
+// names are found.
+func (c *taggingClient) lookUpTags(ctx context.Context, names []string) error {
+	req, err := http.NewRequest("GET", c.baseURL+"/com/vmware/cis/tagging/tag", nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create tag list request")
+	}
+
+	var allIDs []string
+	err = c.do(ctx, req, &allIDs)
+	if err != nil {
+		return errors.Wrap(err, "failed to list tags")
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	for _, id := range allIDs {
+		if len(wanted) == 0 {
+			break
+		}
+
+		req, err := http.NewRequest("GET", c.baseURL+"/com/vmware/cis/tagging/tag/id:"+url.PathEscape(id), nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to create tag request")
+		}
+
+		var tag struct {
+			Name string `json:"name"`
+		}
+		err = c.do(ctx, req, &tag)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get tag with ID %s", id)
+		}
+
+		if wanted[tag.Name] {
+			c.tagIDsByName[tag.Name] = id
+			delete(wanted, tag.Name)
+		}
+	}
+
+	return nil
+}
+
+// forgetTags clears the cached tag IDs, so that they're looked up again, such
+// as after a tag was deleted and created again.
+func (c *taggingClient) forgetTags() {
+	c.tagIDsByName = make(map[string]string)
+}
+
+// attachedObjects returns the objects that a tag is attached to.
+func (c *taggingClient) attachedObjects(ctx context.Context, tagID string) ([]types.ManagedObjectReference, error) {
+	req, err := http.NewRequest("POST", c.baseURL+"/com/vmware/cis/tagging/tag-association/id:"+url.PathEscape(tagID)+"?~action=list-attached-objects", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create attached objects request")
+	}
+
+	var objects []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	err = c.do(ctx, req, &objects)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list objects attached to tag with ID %s", tagID)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(objects))
+	for _, object := range objects {
+		refs = append(refs, types.ManagedObjectReference{Type: object.Type, Value: object.ID})
+	}
+
+	return refs, nil
+}
+
+// do sends a request with the session, if there is one, and decodes the value
+// in the response into value, unless it's nil.
+func (c *taggingClient) do(ctx context.Context, req *http.Request, value interface{}) error {
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.sessionID != "" {
+		req.Header.Set("vmware-api-session-id", c.sessionID)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		return errors.Errorf("vcenter responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	// Every response of the API wraps its result in an object with a single
+	// "value" field.
+	var response struct {
+		Value json.RawMessage `json:"value"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+
+	return errors.Wrap(json.Unmarshal(response.Value, value), "failed to decode response value")
+}
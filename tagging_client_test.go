@@ -0,0 +1,102 @@
+package collectdvsphere
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestTaggingClient(t *testing.T) {
+	var tagRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/rest/com/vmware/cis/session" {
+			user, password, ok := req.BasicAuth()
+			if req.Method != "POST" || !ok || user != "user" || password != "password" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"value": "session-1"}`))
+			return
+		}
+
+		if req.Header.Get("vmware-api-session-id") != "session-1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if strings.HasPrefix(req.URL.Path, "/rest/com/vmware/cis/tagging/tag/") || req.URL.Path == "/rest/com/vmware/cis/tagging/tag" {
+			atomic.AddInt32(&tagRequests, 1)
+		}
+
+		switch req.URL.Path {
+		case "/rest/com/vmware/cis/tagging/tag":
+			w.Write([]byte(`{"value": ["tag-1", "tag-2"]}`))
+		case "/rest/com/vmware/cis/tagging/tag/id:tag-1":
+			w.Write([]byte(`{"value": {"id": "tag-1", "name": "base-image"}}`))
+		case "/rest/com/vmware/cis/tagging/tag/id:tag-2":
+			w.Write([]byte(`{"value": {"id": "tag-2", "name": "other"}}`))
+		case "/rest/com/vmware/cis/tagging/tag-association/id:tag-1":
+			if req.URL.Query().Get("~action") != "list-attached-objects" {
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"value": [{"id": "vm-1", "type": "VirtualMachine"}, {"id": "folder-1", "type": "Folder"}]}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	vSphereURL, _ := url.Parse(server.URL + "/sdk")
+	vSphereURL.User = url.UserPassword("user", "password")
+
+	ctx := context.Background()
+	client := newTaggingClient(vSphereURL, false)
+
+	err := client.login(ctx)
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	defer client.logout(ctx)
+
+	tagIDs, err := client.tagIDs(ctx, []string{"base-image"})
+	if err != nil {
+		t.Fatalf("failed to get tag IDs: %v", err)
+	}
+	if len(tagIDs) != 1 || tagIDs[0] != "tag-1" {
+		t.Fatalf("expected tag IDs [tag-1], but got %v", tagIDs)
+	}
+
+	// The tag ID is cached, so it isn't looked up again.
+	requests := atomic.LoadInt32(&tagRequests)
+	tagIDs, err = client.tagIDs(ctx, []string{"base-image"})
+	if err != nil {
+		t.Fatalf("failed to get cached tag IDs: %v", err)
+	}
+	if made := atomic.LoadInt32(&tagRequests) - requests; len(tagIDs) != 1 || tagIDs[0] != "tag-1" || made != 0 {
+		t.Errorf("expected tag IDs [tag-1] without any requests, but got %v with %d requests", tagIDs, made)
+	}
+
+	refs, err := client.attachedObjects(ctx, "tag-1")
+	if err != nil {
+		t.Fatalf("failed to get attached objects: %v", err)
+	}
+	expected := []types.ManagedObjectReference{
+		{Type: "VirtualMachine", Value: "vm-1"},
+		{Type: "Folder", Value: "folder-1"},
+	}
+	if len(refs) != len(expected) || refs[0] != expected[0] || refs[1] != expected[1] {
+		t.Errorf("expected attached objects %v, but got %v", expected, refs)
+	}
+
+	_, err = client.tagIDs(ctx, []string{"missing", "base-image", "also-missing"})
+	if err == nil || !strings.Contains(err.Error(), "missing, also-missing") {
+		t.Errorf("expected an error naming both tags that don't exist, but got %v", err)
+	}
+}
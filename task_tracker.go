@@ -0,0 +1,59 @@
+package collectdvsphere
+
+import (
+	"time"
+)
+
+// maxTrackedTaskAge is how long a taskTracker remembers a task that was
+// started, but never seen finishing.
+const maxTrackedTaskAge = 6 * time.Hour
+
+// A taskTracker correlates the events at the start and the end of a vSphere
+// task by their event chain ID, to measure how long the task took.
+type taskTracker struct {
+	startTimes map[int32]time.Time
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{
+		startTimes: make(map[int32]time.Time),
+	}
+}
+
+// start records that the task with the given chain ID was started at the
+// given time. If the task was already started, the earliest start time is
+// kept.
+func (t *taskTracker) start(chainID int32, startTime time.Time) {
+	t.expire(startTime)
+
+	if previous, ok := t.startTimes[chainID]; ok && !previous.After(startTime) {
+		return
+	}
+
+	t.startTimes[chainID] = startTime
+}
+
+// finish returns the duration of the task with the given chain ID and stops
+// tracking it. ok is false if the start of the task wasn't seen.
+func (t *taskTracker) finish(chainID int32, finishTime time.Time) (duration time.Duration, ok bool) {
+	startTime, ok := t.startTimes[chainID]
+	if !ok {
+		return 0, false
+	}
+	delete(t.startTimes, chainID)
+
+	return finishTime.Sub(startTime), true
+}
+
+// forget stops tracking the task with the given chain ID.
+func (t *taskTracker) forget(chainID int32) {
+	delete(t.startTimes, chainID)
+}
+
+func (t *taskTracker) expire(now time.Time) {
+	for chainID, startTime := range t.startTimes {
+		if now.Sub(startTime) > maxTrackedTaskAge {
+			delete(t.startTimes, chainID)
+		}
+	}
+}
@@ -3,13 +3,18 @@ package collectdvsphere
 import (
 	"context"
 	"net/url"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	raven "github.com/getsentry/raven-go"
 	"github.com/pkg/errors"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/event"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 )
@@ -21,6 +26,40 @@ type VSphereEventListener struct {
 	statsCollector *StatsCollector
 	client         *govmomi.Client
 	logger         logrus.FieldLogger
+
+	cloneTasks   *taskTracker
+	powerOnTasks *taskTracker
+
+	checkpoint *eventCheckpoint
+
+	// Whether the checkpoint is saved together with the counters, in the
+	// counter state file of the StatsCollector, instead of in its own file
+	checkpointWithCounters bool
+
+	// Optional recorder that's given every handled event
+	eventRecorder EventRecorder
+
+	// Names of hosts and VMs looked up for events that didn't include them,
+	// and a mutex held while using them, since they're also looked up while
+	// rescanning
+	entityNames      map[types.ManagedObjectReference]string
+	entityNamesMutex sync.Mutex
+
+	// Names of the hosts and base VMs found the last time they were looked
+	// for
+	hostNames   map[string]bool
+	baseVMNames map[string]bool
+
+	// Client for the tagging API, if base VMs are found by tag
+	tagging *taggingClient
+
+	// Delays between attempts to reconnect, which are only changed by tests
+	minReconnectBackoff time.Duration
+	maxReconnectBackoff time.Duration
+
+	// How much of the time range is read at once when backfilling, which is
+	// only changed by tests
+	backfillReadPeriod time.Duration
 }
 
 // A VSphereConfig provides configuration for a VSphereEventListener
@@ -29,27 +68,154 @@ type VSphereConfig struct {
 	Insecure     bool
 	ClusterPaths []string
 	BaseVMPaths  []string
+
+	// Base VMs can also be selected by matching their names against
+	// BaseVMNamePattern, if it's set, or by having any of the vSphere tags
+	// named in BaseVMTags, wherever they are in the inventory.
+	BaseVMNamePattern *regexp.Regexp
+	BaseVMTags        []string
+
+	// Path to the file the last handled event is stored in, to resume from
+	// there after a restart. If empty, events are only replayed after a
+	// reconnect.
+	CheckpointPath string
+
+	// How long a host that was removed from the clusters keeps being
+	// reported, so that its last values are still sent.
+	HostRemovalGracePeriod time.Duration
+
+	// How often the hosts in the clusters are looked for again, to find the
+	// ones that were added or removed without an event for it. If 0, they're
+	// only looked for when connecting.
+	HostRescanInterval time.Duration
+
+	// How often base VMs are looked for again, to find the ones that were
+	// added or removed. If 0, they're only looked for when connecting.
+	BaseVMRescanInterval time.Duration
+
+	// How many levels of sub-folders and vApps below the base VM folders are
+	// searched for base VMs. If 0, only the VMs directly in the base VM
+	// folders are found, and if negative, there's no limit.
+	BaseVMFolderDepth int
 }
 
 // NewVSphereEventListener creates a VSphereEventListener with a given
 // configuration. Call Start on the event listener to start listening and
 // reporting to the given stats collector.
 func NewVSphereEventListener(config VSphereConfig, statsCollector *StatsCollector, logger logrus.FieldLogger) *VSphereEventListener {
+	var tagging *taggingClient
+	if len(config.BaseVMTags) > 0 {
+		tagging = newTaggingClient(config.URL, config.Insecure)
+	}
+
 	return &VSphereEventListener{
 		config:         config,
 		statsCollector: statsCollector,
 		logger:         logger,
+		cloneTasks:     newTaskTracker(),
+		powerOnTasks:   newTaskTracker(),
+		checkpoint:     newEventCheckpoint(config.CheckpointPath),
+		entityNames:    make(map[types.ManagedObjectReference]string),
+		hostNames:      make(map[string]bool),
+		baseVMNames:    make(map[string]bool),
+		tagging:        tagging,
+
+		minReconnectBackoff: minReconnectBackoff,
+		maxReconnectBackoff: maxReconnectBackoff,
+		backfillReadPeriod:  defaultBackfillReadPeriod,
 	}
 }
 
+// SetEventRecorder sets an EventRecorder to give every handled event to. It
+// must be called before Start.
+func (l *VSphereEventListener) SetEventRecorder(recorder EventRecorder) {
+	l.eventRecorder = recorder
+}
+
+// replayEventPageSize is the number of events read at a time when reading
+// past events.
+const replayEventPageSize = 100
+
+// Reconnection delays used by Start. The delay doubles on every failed attempt
+// to connect, and is reset once a connection has stayed up for longer than
+// maxReconnectBackoff.
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 5 * time.Minute
+)
+
 // Start starts the event listener and begins reporting stats to the
-// StatsCollector.
+// StatsCollector. If the connection to vSphere fails, a new connection is made
+// and the hosts and base VMs are prefilled again, with an exponential backoff
+// between attempts. Events that happened since the last handled event are
+// replayed when (re)connecting. Start blocks until the context is cancelled.
 func (l *VSphereEventListener) Start(ctx context.Context) error {
-	err := l.makeClient(ctx)
+	err := l.loadCheckpoint()
 	if err != nil {
-		return errors.Wrap(err, "couldn't create vSphere client")
+		return err
+	}
+
+	l.statsCollector.ensureVCenterExists(l.vCenterName())
+
+	l.runWithReconnects(ctx, l.makeClient, l.run)
+	return nil
+}
+
+// runWithReconnects calls connect and then run until the context is cancelled,
+// waiting with an exponential backoff after every failure. Every successful
+// connection after the first is counted as a reconnect.
+func (l *VSphereEventListener) runWithReconnects(ctx context.Context, connect, run func(ctx context.Context) error) {
+	connected := false
+	backoff := l.minReconnectBackoff
+	for {
+		startTime := time.Now()
+		err := connect(ctx)
+		if err != nil {
+			err = errors.Wrap(err, "couldn't create vSphere client")
+		} else {
+			if connected {
+				l.statsCollector.MarkReconnect(l.vCenterName())
+			}
+			connected = true
+
+			err = run(ctx)
+		}
+		l.closeClient()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("event stream ended")
+		}
+
+		if time.Since(startTime) > l.maxReconnectBackoff {
+			backoff = l.minReconnectBackoff
+		}
+
+		l.logger.WithFields(logrus.Fields{
+			"err":     err,
+			"backoff": backoff,
+		}).Error("event listener failed, reconnecting")
+		raven.CaptureError(err, nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > l.maxReconnectBackoff {
+			backoff = l.maxReconnectBackoff
+		}
 	}
-	err = l.prefillHosts(ctx)
+}
+
+// run prefills the hosts and base VMs, replays missed events and handles new
+// events until the connection fails.
+func (l *VSphereEventListener) run(ctx context.Context) error {
+	err := l.prefillHosts(ctx)
 	if err != nil {
 		return errors.Wrap(err, "couldn't prefill hosts")
 	}
@@ -66,65 +232,406 @@ func (l *VSphereEventListener) Start(ctx context.Context) error {
 		return err
 	}
 
+	err = l.replayEvents(ctx, clusterRefs)
+	if err != nil {
+		return errors.Wrap(err, "couldn't replay events since checkpoint")
+	}
+
+	// The rescans use the client, so they have to be stopped before run
+	// returns and the client is closed.
+	rescanCtx, cancelRescans := context.WithCancel(ctx)
+	var rescans sync.WaitGroup
+	rescans.Add(2)
+	go func() {
+		defer rescans.Done()
+		l.rescan(rescanCtx, l.config.HostRescanInterval, "hosts", l.prefillHosts)
+	}()
+	go func() {
+		defer rescans.Done()
+		if l.hasBaseVMSelectors() {
+			l.rescan(rescanCtx, l.config.BaseVMRescanInterval, "base VMs", l.prefillBaseVMs)
+		}
+	}()
+	defer func() {
+		cancelRescans()
+		rescans.Wait()
+	}()
+
 	eventManager := event.NewManager(l.client.Client)
 
 	l.logger.WithField("cluster-count", len(clusterRefs)).Info("starting event listener")
-	err = eventManager.Events(ctx, clusterRefs, 25, true, false, l.handleEvents)
+	err = eventManager.Events(ctx, clusterRefs, 25, true, false, func(ee []types.BaseEvent) error {
+		return l.handleEvents(ctx, ee, true)
+	})
 
 	return errors.Wrap(err, "event handling failed")
 }
 
-func (l *VSphereEventListener) handleEvents(ee []types.BaseEvent) error {
+// rescan calls scan every interval until the context is cancelled, to find
+// changes to the inventory that might not have events, such as the hosts or
+// base VMs that were added or removed. Failed scans are logged and tried again
+// at the next interval. If the interval is 0, rescan returns right away.
+func (l *VSphereEventListener) rescan(ctx context.Context, interval time.Duration, what string, scan func(ctx context.Context) error) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := scan(ctx)
+		if err != nil && ctx.Err() == nil {
+			l.logger.WithFields(logrus.Fields{
+				"err":       err,
+				"inventory": what,
+			}).Error("failed to rescan inventory")
+		}
+	}
+}
+
+// replayEvents handles the events on the given clusters that happened since the
+// start of the checkpoint's window, which includes any that were missed while
+// disconnected or not running.
+func (l *VSphereEventListener) replayEvents(ctx context.Context, clusterRefs []types.ManagedObjectReference) error {
+	since := l.checkpoint.replayFrom()
+	if since.IsZero() {
+		return nil
+	}
+
+	eventManager := event.NewManager(l.client.Client)
+
+	var events []types.BaseEvent
+	for _, clusterRef := range clusterRefs {
+		clusterEvents, err := readEvents(ctx, eventManager, clusterRef, &since, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read events for compute cluster with ID %s", clusterRef)
+		}
+		events = append(events, clusterEvents...)
+	}
+
+	l.logger.WithFields(logrus.Fields{
+		"since":       since,
+		"event_count": len(events),
+	}).Info("replaying events since checkpoint")
+
+	return l.handleEvents(ctx, events, false)
+}
+
+// readEvents returns all events on an entity and its children that happened
+// between beginTime and endTime. If either of them is nil, that end of the time
+// range is left open.
+func readEvents(ctx context.Context, eventManager *event.Manager, ref types.ManagedObjectReference, beginTime, endTime *time.Time) ([]types.BaseEvent, error) {
+	collector, err := eventManager.CreateCollectorForEvents(ctx, types.EventFilterSpec{
+		Entity: &types.EventFilterSpecByEntity{
+			Entity:    ref,
+			Recursion: types.EventFilterSpecRecursionOptionAll,
+		},
+		Time: &types.EventFilterSpecByTime{
+			BeginTime: beginTime,
+			EndTime:   endTime,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create event collector")
+	}
+	defer collector.Destroy(ctx)
+
+	err = collector.Rewind(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to rewind event collector")
+	}
+
+	var events []types.BaseEvent
+	for {
+		page, err := collector.ReadNextEvents(ctx, replayEventPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read events")
+		}
+		if len(page) == 0 {
+			return events, nil
+		}
+		events = append(events, page...)
+	}
+}
+
+// loadCheckpoint loads the event checkpoint. If the StatsCollector persists
+// its counters, the checkpoint is kept in its counter state file from then on,
+// so that a crash can't leave the counters and the checkpoint disagreeing on
+// which events were counted. The checkpoint file is only read if the counter
+// state file doesn't have a checkpoint yet.
+func (l *VSphereEventListener) loadCheckpoint() error {
+	if l.checkpoint.path != "" && l.statsCollector.persistsCounters() {
+		l.checkpointWithCounters = true
+		if state := l.statsCollector.restoredEventCheckpoint(); state != nil {
+			l.checkpoint.restore(*state)
+			l.statsCollector.saveEventCheckpoint(l.checkpoint)
+			return nil
+		}
+	}
+
+	err := l.checkpoint.load()
+	if err != nil {
+		return errors.Wrap(err, "couldn't load event checkpoint")
+	}
+
+	if l.checkpointWithCounters {
+		l.statsCollector.saveEventCheckpoint(l.checkpoint)
+	}
+	return nil
+}
+
+// handleEvents counts the events that weren't handled yet. Events are live if
+// they just happened, rather than being replayed or backfilled.
+func (l *VSphereEventListener) handleEvents(ctx context.Context, ee []types.BaseEvent, live bool) error {
+	// The events in a page aren't ordered, but the start of a task has to be
+	// seen before its end to be able to time it.
+	event.Sort(ee)
+
 	for _, baseEvent := range ee {
-		// TODO: A lot of the Host and Vm args can be nil, we should handle that
-		switch e := baseEvent.(type) {
-		case *types.VmPoweredOnEvent:
-			l.statsCollector.MarkPowerOnSuccess(e.Host.Name)
-		case *types.VmFailedToPowerOnEvent:
-			l.statsCollector.MarkPowerOnFailure(e.Host.Name)
-		case *types.VmPoweredOffEvent:
-			l.statsCollector.MarkPowerOffSuccess(e.Host.Name)
-		case *types.VmFailedToPowerOffEvent:
-			l.statsCollector.MarkPowerOffFailure(e.Host.Name)
-		case *types.VmClonedEvent:
-			l.statsCollector.MarkCloneSuccess(e.SourceVm.Name)
-		case *types.VmCloneFailedEvent:
-			l.statsCollector.MarkCloneFailure(e.Vm.Name)
+		if l.checkpoint.handled(baseEvent.GetEvent()) {
+			continue
 		}
+
+		// The names are looked up first, since saving the counters has to
+		// wait while an event is counted.
+		names := l.eventNames(ctx, baseEvent, live)
+		l.statsCollector.countEvent(func() {
+			l.handleEvent(baseEvent, names)
+		})
+	}
+
+	if l.checkpointWithCounters {
+		return nil
+	}
+
+	err := l.checkpoint.save()
+	if err != nil {
+		l.logger.WithField("err", err).Error("failed to save event checkpoint")
 	}
 
 	return nil
 }
 
+// eventEntityNames are the names of the hosts and base VM an event is counted
+// under.
+type eventEntityNames struct {
+	host       string
+	sourceHost string
+	baseVM     string
+}
+
+// eventNames looks up the names of the hosts and base VM an event is counted
+// under. For events on hosts, the compute cluster and datacenter of the host
+// are recorded too.
+func (l *VSphereEventListener) eventNames(ctx context.Context, baseEvent types.BaseEvent, live bool) eventEntityNames {
+	var names eventEntityNames
+	switch e := baseEvent.(type) {
+	case *types.HostRemovedEvent:
+		names.host = l.hostName(ctx, e, live)
+	case *types.HostAddedEvent, *types.VmPoweredOnEvent, *types.VmFailedToPowerOnEvent, *types.VmPoweredOffEvent, *types.VmFailedToPowerOffEvent, *types.VmFailedMigrateEvent:
+		names.host = l.eventHostName(ctx, baseEvent, live)
+	case *types.VmMigratedEvent:
+		names.sourceHost = l.hostArgName(ctx, e, e.SourceHost)
+		names.host = l.eventHostName(ctx, e, live)
+	case *types.DrsVmMigratedEvent:
+		names.sourceHost = l.hostArgName(ctx, e, e.SourceHost)
+		names.host = l.eventHostName(ctx, e, live)
+	case *types.VmClonedEvent:
+		names.baseVM = l.vmArgName(ctx, e, &e.SourceVm)
+	case *types.VmCloneFailedEvent:
+		names.baseVM = l.vmArgName(ctx, e, e.Vm)
+	}
+
+	return names
+}
+
+// handleEvent counts an event under the given names, unless it was already
+// handled.
+func (l *VSphereEventListener) handleEvent(baseEvent types.BaseEvent, names eventEntityNames) {
+	if !l.checkpoint.markHandled(baseEvent.GetEvent()) {
+		return
+	}
+
+	if l.eventRecorder != nil {
+		err := l.eventRecorder.RecordEvent(newEventRecord(baseEvent))
+		if err != nil {
+			l.logger.WithField("err", err).Warn("failed to record event")
+		}
+	}
+
+	switch e := baseEvent.(type) {
+	case *types.TaskEvent:
+		l.handleTaskEvent(e)
+	case *types.HostAddedEvent:
+		l.handleHostAdded(names.host)
+	case *types.HostRemovedEvent:
+		l.handleHostRemoved(e, names.host)
+	case *types.VmStartingEvent:
+		l.powerOnTasks.start(e.ChainId, e.CreatedTime)
+	case *types.VmPoweredOnEvent:
+		l.statsCollector.MarkPowerOnSuccess(names.host)
+		if duration, ok := l.powerOnTasks.finish(e.ChainId, e.CreatedTime); ok {
+			l.statsCollector.ObservePowerOnDuration(names.host, duration)
+		}
+	case *types.VmFailedToPowerOnEvent:
+		l.statsCollector.MarkPowerOnFailure(names.host)
+		l.powerOnTasks.forget(e.ChainId)
+	case *types.VmPoweredOffEvent:
+		l.statsCollector.MarkPowerOffSuccess(names.host)
+	case *types.VmFailedToPowerOffEvent:
+		l.statsCollector.MarkPowerOffFailure(names.host)
+	case *types.VmMigratedEvent, *types.DrsVmMigratedEvent:
+		l.handleMigration(names.sourceHost, names.host)
+	case *types.VmFailedMigrateEvent:
+		l.statsCollector.MarkMigrateFailure(names.host)
+	case *types.VmBeingClonedEvent:
+		l.cloneTasks.start(e.ChainId, e.CreatedTime)
+	case *types.VmBeingClonedNoFolderEvent:
+		l.cloneTasks.start(e.ChainId, e.CreatedTime)
+	case *types.VmClonedEvent:
+		l.statsCollector.setLocation(EntityBaseVM, names.baseVM, "", eventDatacenter(e))
+		l.statsCollector.MarkCloneSuccess(names.baseVM)
+		if duration, ok := l.cloneTasks.finish(e.ChainId, e.CreatedTime); ok {
+			l.statsCollector.ObserveCloneDuration(names.baseVM, duration)
+		}
+	case *types.VmCloneFailedEvent:
+		l.statsCollector.setLocation(EntityBaseVM, names.baseVM, "", eventDatacenter(e))
+		l.statsCollector.MarkCloneFailure(names.baseVM)
+		l.cloneTasks.forget(e.ChainId)
+	}
+}
+
+// handleTaskEvent records when power-on tasks were queued, which is earlier
+// than the VmStartingEvent if the task had to wait.
+func (l *VSphereEventListener) handleTaskEvent(e *types.TaskEvent) {
+	if e.Info.DescriptionId != "VirtualMachine.powerOn" {
+		return
+	}
+
+	startTime := e.Info.QueueTime
+	if startTime.IsZero() && e.Info.StartTime != nil {
+		startTime = *e.Info.StartTime
+	}
+	if startTime.IsZero() {
+		return
+	}
+
+	l.powerOnTasks.start(e.Info.EventChainId, startTime)
+}
+
+// handleHostAdded starts reporting a host that was added to a cluster right
+// away, instead of after the first event on it.
+func (l *VSphereEventListener) handleHostAdded(hostName string) {
+	if hostName == unattributedEntity {
+		return
+	}
+
+	l.logger.WithField("name", hostName).Info("host added")
+	l.statsCollector.ensureHostExists(hostName)
+}
+
+// handleHostRemoved stops reporting a host that was removed from a cluster,
+// once the grace period has passed.
+func (l *VSphereEventListener) handleHostRemoved(e *types.HostRemovedEvent, hostName string) {
+	if hostName == unattributedEntity {
+		return
+	}
+
+	l.logger.WithField("name", hostName).Info("host removed")
+	l.statsCollector.retireEntity(EntityHost, hostName, e.CreatedTime.Add(l.config.HostRemovalGracePeriod))
+}
+
+func (l *VSphereEventListener) handleMigration(sourceHostName, destinationHostName string) {
+	// A migration that stays on the same host (e.g. a Storage vMotion) doesn't
+	// move any load between hosts, so it's not counted.
+	if sourceHostName == destinationHostName && sourceHostName != unattributedEntity {
+		return
+	}
+
+	l.statsCollector.MarkMigrateOut(sourceHostName)
+	l.statsCollector.MarkMigrateIn(destinationHostName)
+}
+
 func (l *VSphereEventListener) makeClient(ctx context.Context) (err error) {
 	l.client, err = govmomi.NewClient(ctx, l.config.URL, l.config.Insecure)
 
 	return errors.Wrap(err, "failed to create govmomi client")
 }
 
+// closeClient logs out of the vSphere session, if there is one. Errors are
+// ignored, since the session is usually gone already when this is called.
+func (l *VSphereEventListener) closeClient() {
+	if l.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = l.client.Logout(ctx)
+	l.client = nil
+}
+
+// vCenterName returns the hostname of the vSphere API, which is used to report
+// metrics about the connection to it.
+func (l *VSphereEventListener) vCenterName() string {
+	return l.config.URL.Hostname()
+}
+
 func (l *VSphereEventListener) clusterReferences(ctx context.Context) ([]types.ManagedObjectReference, error) {
+	clusters, err := l.clusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterRefs := make([]types.ManagedObjectReference, 0, len(clusters))
+	for _, cluster := range clusters {
+		clusterRefs = append(clusterRefs, cluster.Reference())
+	}
+
+	return clusterRefs, nil
+}
+
+// clusters returns the compute clusters in the configured cluster paths, with
+// their inventory paths set.
+func (l *VSphereEventListener) clusters(ctx context.Context) ([]*object.ClusterComputeResource, error) {
 	finder := find.NewFinder(l.client.Client, true)
 
-	clusters := make([]types.ManagedObjectReference, 0, len(l.config.ClusterPaths))
+	clusters := make([]*object.ClusterComputeResource, 0, len(l.config.ClusterPaths))
 	for _, path := range l.config.ClusterPaths {
 		cluster, err := finder.ClusterComputeResource(ctx, path)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to find cluster with path %s", path)
 		}
-		clusters = append(clusters, cluster.Reference())
+		clusters = append(clusters, cluster)
 	}
 
 	return clusters, nil
 }
 
 func (l *VSphereEventListener) prefillHosts(ctx context.Context) error {
-	clusterRefs, err := l.clusterReferences(ctx)
+	clusters, err := l.clusters(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to get references to compute clusters")
+		return errors.Wrap(err, "failed to get compute clusters")
 	}
 
-	for _, clusterRef := range clusterRefs {
-		hosts, err := object.NewClusterComputeResource(l.client.Client, clusterRef).Hosts(ctx)
+	present := make(map[string]bool)
+	for _, cluster := range clusters {
+		clusterRef := cluster.Reference()
+		clusterName := l.entityName(ctx, "", clusterRef)
+		datacenterName, err := l.datacenterName(ctx, clusterRef)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find datacenter of compute cluster with ID %s", clusterRef)
+		}
+
+		hosts, err := cluster.Hosts(ctx)
 		if err != nil {
 			return errors.Wrapf(err, "failed to list hosts in compute cluster with ID %s", clusterRef)
 		}
@@ -136,51 +643,304 @@ func (l *VSphereEventListener) prefillHosts(ctx context.Context) error {
 				return errors.Wrapf(err, "failed to get summary for host with ID %s", host.Reference())
 			}
 			name := mhost.Summary.Config.Name
-			l.logger.WithField("name", name).Info("prefilling host")
+			if !l.hostNames[name] {
+				l.logger.WithField("name", name).Info("prefilling host")
+			}
 			if name != "" {
 				l.statsCollector.ensureHostExists(name)
+				l.statsCollector.setLocation(EntityHost, name, clusterName, datacenterName)
+				present[name] = true
 			}
 		}
 	}
 
+	// Hosts that were removed while disconnected won't have a removal event
+	// that's replayed, so they're retired here.
+	retired := l.statsCollector.retireMissingEntities(EntityHost, present, time.Now().Add(l.config.HostRemovalGracePeriod))
+	for _, name := range retired {
+		l.logger.WithField("name", name).Info("host is no longer in the clusters, retiring it")
+	}
+
+	l.hostNames = present
 	return nil
 }
 
+// hasBaseVMSelectors returns whether any way of finding base VMs is
+// configured.
+func (l *VSphereEventListener) hasBaseVMSelectors() bool {
+	return len(l.config.BaseVMPaths) > 0 || l.config.BaseVMNamePattern != nil || len(l.config.BaseVMTags) > 0
+}
+
+// prefillBaseVMs adds the base VMs to the StatsCollector, and retires the ones
+// that are no longer found since the last time they were looked for.
 func (l *VSphereEventListener) prefillBaseVMs(ctx context.Context) error {
-	if len(l.config.BaseVMPaths) == 0 {
-		// Skip if no base VM path, for backwards compatibility with v1.0.0
+	if !l.hasBaseVMSelectors() {
+		// Skip if base VMs aren't selected by folder, name or tag, for
+		// backwards compatibility with v1.0.0
 		return nil
 	}
 
+	baseVMs, err := l.findBaseVMs(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.updateBaseVMs(baseVMs)
+	return nil
+}
+
+// updateBaseVMs adds the given base VMs, mapped to the names of their
+// datacenters, to the StatsCollector. Every other base VM, such as one that was
+// removed or one restored from the counter state file that no longer exists,
+// is retired after BaseVMRescanInterval, unless it's found again or cloned
+// before then, so that one that's only missing briefly, such as while it's
+// being replaced, isn't dropped. If base VMs aren't rescanned, nothing is
+// retired, since one that's only found by being cloned would otherwise be
+// dropped on every reconnect.
+func (l *VSphereEventListener) updateBaseVMs(baseVMs map[string]string) {
+	present := make(map[string]bool, len(baseVMs))
+	for name, datacenterName := range baseVMs {
+		if !l.baseVMNames[name] {
+			l.logger.WithField("name", name).Info("prefilling base VM")
+		}
+		l.statsCollector.ensureBaseVMExists(name)
+		l.statsCollector.setLocation(EntityBaseVM, name, "", datacenterName)
+		present[name] = true
+	}
+
+	l.baseVMNames = present
+	if l.config.BaseVMRescanInterval <= 0 {
+		return
+	}
+
+	retired := l.statsCollector.retireMissingEntities(EntityBaseVM, present, time.Now().Add(l.config.BaseVMRescanInterval))
+	for _, name := range retired {
+		l.logger.WithField("name", name).Info("base VM is no longer found, retiring it")
+	}
+}
+
+// findBaseVMs returns the names of the base VMs that are in the base VM folders
+// or match the name pattern or tags, mapped to the names of their datacenters
+// if they're known. Both VMs and templates are base VMs.
+func (l *VSphereEventListener) findBaseVMs(ctx context.Context) (map[string]string, error) {
 	finder := find.NewFinder(l.client.Client, true)
+	inventory := vSphereInventory{client: l.client.Client}
+
+	baseVMs := make(map[string]string)
 	for _, baseVMPath := range l.config.BaseVMPaths {
 		folder, err := finder.Folder(ctx, baseVMPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to find base vm folder with path %s", baseVMPath)
+			return nil, errors.Wrapf(err, "failed to find base vm folder with path %s", baseVMPath)
+		}
+
+		datacenterName, err := l.datacenterName(ctx, folder.Reference())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find datacenter of base vm folder with path %s", baseVMPath)
+		}
+
+		err = l.findBaseVMsInFolder(ctx, inventory, folder.Reference(), l.config.BaseVMFolderDepth, nil, datacenterName, baseVMs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find base VMs in base vm folder with path %s", baseVMPath)
 		}
+	}
 
-		children, err := folder.Children(ctx)
+	if l.config.BaseVMNamePattern != nil {
+		err := l.findBaseVMsByName(ctx, inventory, baseVMs)
 		if err != nil {
-			return errors.Wrapf(err, "failed to list children of base vm folder with path %s", baseVMPath)
+			return nil, errors.Wrapf(err, "failed to find base VMs with names matching %s", l.config.BaseVMNamePattern)
 		}
+	}
 
-		for _, vmRef := range children {
-			vm, ok := vmRef.(*object.VirtualMachine)
-			if !ok {
-				continue
+	if len(l.config.BaseVMTags) > 0 {
+		err := l.findBaseVMsByTag(ctx, baseVMs)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find base VMs by tag")
+		}
+	}
+
+	return baseVMs, nil
+}
+
+// findBaseVMsByName adds the VMs and templates anywhere in the VM folders of
+// the datacenters whose names match BaseVMNamePattern to baseVMs.
+func (l *VSphereEventListener) findBaseVMsByName(ctx context.Context, inventory baseVMInventory, baseVMs map[string]string) error {
+	datacenters, err := find.NewFinder(l.client.Client, true).DatacenterList(ctx, "*")
+	if err != nil {
+		return errors.Wrap(err, "failed to list datacenters")
+	}
+
+	for _, datacenter := range datacenters {
+		folders, err := datacenter.Folders(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get folders of datacenter with ID %s", datacenter.Reference())
+		}
+
+		datacenterName := l.entityName(ctx, "", datacenter.Reference())
+		err = l.findBaseVMsByNameInFolder(ctx, inventory, folders.VmFolder.Reference(), datacenterName, baseVMs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findBaseVMsByNameInFolder adds the VMs and templates anywhere in a folder
+// whose names match BaseVMNamePattern to baseVMs.
+func (l *VSphereEventListener) findBaseVMsByNameInFolder(ctx context.Context, inventory baseVMInventory, folder types.ManagedObjectReference, datacenterName string, baseVMs map[string]string) error {
+	return l.findBaseVMsInFolder(ctx, inventory, folder, -1, l.config.BaseVMNamePattern, datacenterName, baseVMs)
+}
+
+// findBaseVMsByTag adds the VMs and templates that have any of the tags in
+// BaseVMTags to baseVMs.
+func (l *VSphereEventListener) findBaseVMsByTag(ctx context.Context, baseVMs map[string]string) error {
+	err := l.tagging.login(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.tagging.logout(ctx)
+
+	tagIDs, err := l.tagging.tagIDs(ctx, l.config.BaseVMTags)
+	if err != nil {
+		return err
+	}
+
+	// A VM can have more than one of the tags, but it's only retrieved once.
+	seen := make(map[types.ManagedObjectReference]bool)
+	var vmRefs []types.ManagedObjectReference
+	for _, tagID := range tagIDs {
+		refs, err := l.tagging.attachedObjects(ctx, tagID)
+		if err != nil {
+			// The tag might have been deleted since its ID was cached.
+			l.tagging.forgetTags()
+			return err
+		}
+
+		for _, ref := range refs {
+			if ref.Type == "VirtualMachine" && !seen[ref] {
+				seen[ref] = true
+				vmRefs = append(vmRefs, ref)
 			}
+		}
+	}
+	if len(vmRefs) == 0 {
+		return nil
+	}
 
-			var mvm mo.VirtualMachine
-			err := vm.Properties(ctx, vm.Reference(), []string{"config"}, &mvm)
-			if err != nil {
-				return errors.Wrapf(err, "failed to get config for base VM with ID %s", vmRef.Reference())
+	var mvms []mo.VirtualMachine
+	err = property.DefaultCollector(l.client.Client).Retrieve(ctx, vmRefs, []string{"name"}, &mvms)
+	if err != nil {
+		return errors.Wrap(err, "failed to get names of tagged VMs")
+	}
+
+	for _, mvm := range mvms {
+		addBaseVMName(baseVMs, mvm.Name)
+	}
+
+	return nil
+}
+
+// addBaseVMName adds a base VM whose datacenter isn't known to baseVMs,
+// keeping the datacenter if it was already found in a base VM folder.
+func addBaseVMName(baseVMs map[string]string, name string) {
+	if _, ok := baseVMs[name]; !ok && name != "" {
+		baseVMs[name] = ""
+	}
+}
+
+// findBaseVMsInFolder adds the base VMs in a folder to baseVMs, and those in
+// its sub-folders and vApps down to the given depth. If depth is negative,
+// there's no limit. If pattern isn't nil, only the VMs whose names match it are
+// base VMs.
+func (l *VSphereEventListener) findBaseVMsInFolder(ctx context.Context, inventory baseVMInventory, folder types.ManagedObjectReference, depth int, pattern *regexp.Regexp, datacenterName string, baseVMs map[string]string) error {
+	children, err := inventory.folderChildren(ctx, folder)
+	if err != nil {
+		return err
+	}
+
+	var vmRefs []types.ManagedObjectReference
+	for _, child := range children {
+		var err error
+		switch child.Type {
+		case "VirtualMachine":
+			vmRefs = append(vmRefs, child)
+		case "Folder":
+			if depth != 0 {
+				err = l.findBaseVMsInFolder(ctx, inventory, child, depth-1, pattern, datacenterName, baseVMs)
 			}
-			name := mvm.Config.Name
-			l.logger.WithField("name", name).Info("prefilling base VM")
-			if name != "" {
-				l.statsCollector.ensureBaseVMExists(name)
+		case "VirtualApp":
+			if depth != 0 {
+				err = l.findBaseVMsInVApp(ctx, inventory, child, depth-1, pattern, datacenterName, baseVMs)
 			}
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.addBaseVMs(ctx, inventory, vmRefs, pattern, datacenterName, baseVMs)
+}
+
+// findBaseVMsInVApp adds the base VMs in a vApp to baseVMs, and those in its
+// child vApps down to the given depth.
+func (l *VSphereEventListener) findBaseVMsInVApp(ctx context.Context, inventory baseVMInventory, vApp types.ManagedObjectReference, depth int, pattern *regexp.Regexp, datacenterName string, baseVMs map[string]string) error {
+	vmRefs, childRefs, err := inventory.vAppContents(ctx, vApp)
+	if err != nil {
+		return err
+	}
+
+	err = l.addBaseVMs(ctx, inventory, vmRefs, pattern, datacenterName, baseVMs)
+	if err != nil {
+		return err
+	}
+
+	if depth == 0 {
+		return nil
+	}
+
+	for _, childRef := range childRefs {
+		err := l.findBaseVMsInVApp(ctx, inventory, childRef, depth-1, pattern, datacenterName, baseVMs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addBaseVMs adds the names of VMs and templates to baseVMs. If pattern isn't
+// nil, only the VMs whose names match it and that aren't in baseVMs yet are
+// added, and only the names of the others are retrieved.
+func (l *VSphereEventListener) addBaseVMs(ctx context.Context, inventory baseVMInventory, vmRefs []types.ManagedObjectReference, pattern *regexp.Regexp, datacenterName string, baseVMs map[string]string) error {
+	if pattern != nil {
+		named, err := inventory.vmNames(ctx, vmRefs)
+		if err != nil {
+			return err
+		}
+
+		vmRefs = nil
+		for _, mvm := range named {
+			if _, ok := baseVMs[mvm.Name]; !ok && pattern.MatchString(mvm.Name) {
+				vmRefs = append(vmRefs, mvm.Reference())
+			}
+		}
+	}
+
+	mvms, err := inventory.virtualMachines(ctx, vmRefs)
+	if err != nil {
+		return err
+	}
+
+	for _, mvm := range mvms {
+		if mvm.Name == "" {
+			continue
+		}
+
+		l.logger.WithFields(logrus.Fields{
+			"name":     mvm.Name,
+			"template": mvm.Config != nil && mvm.Config.Template,
+		}).Debug("found base VM")
+		baseVMs[mvm.Name] = datacenterName
 	}
 
 	return nil
@@ -0,0 +1,684 @@
+package collectdvsphere
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	"collectd.org/api"
+)
+
+func hostArg(name string) types.HostEventArgument {
+	return types.HostEventArgument{EntityEventArgument: types.EntityEventArgument{Name: name}}
+}
+
+func vmArg(name string) types.VmEventArgument {
+	return types.VmEventArgument{EntityEventArgument: types.EntityEventArgument{Name: name}}
+}
+
+func TestVSphereEventListenerMigrations(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	srcHost := hostArg("src-host")
+	dstHost := hostArg("dst-host")
+
+	migrated := &types.VmMigratedEvent{SourceHost: srcHost}
+	migrated.Key = 1
+	migrated.Host = &dstHost
+
+	migratedAgain := &types.VmMigratedEvent{SourceHost: srcHost}
+	migratedAgain.Key = 2
+	migratedAgain.Host = &dstHost
+
+	drsMigrated := &types.DrsVmMigratedEvent{VmMigratedEvent: types.VmMigratedEvent{SourceHost: dstHost}}
+	drsMigrated.Key = 3
+	drsMigrated.Host = &srcHost
+
+	storageMigrated := &types.VmMigratedEvent{SourceHost: srcHost}
+	storageMigrated.Key = 4
+	storageMigrated.Host = &srcHost
+
+	failedMigrate := &types.VmFailedMigrateEvent{DestHost: dstHost}
+	failedMigrate.Key = 5
+	failedMigrate.Host = &srcHost
+
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{migrated, migratedAgain, drsMigrated, storageMigrated, failedMigrate}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	err = collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"src-host/vsphere-foo-instance/operations-migrate_in", api.Derive(1)},
+		{"src-host/vsphere-foo-instance/operations-migrate_out", api.Derive(2)},
+		{"src-host/vsphere-foo-instance/operations-migrate_failure", api.Derive(1)},
+
+		{"dst-host/vsphere-foo-instance/operations-migrate_in", api.Derive(2)},
+		{"dst-host/vsphere-foo-instance/operations-migrate_out", api.Derive(1)},
+		{"dst-host/vsphere-foo-instance/operations-migrate_failure", api.Derive(0)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+func TestVSphereEventListenerCloneDuration(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	startTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	baseVM := vmArg("base-image")
+
+	beingCloned := &types.VmBeingClonedEvent{}
+	beingCloned.Key = 1
+	beingCloned.ChainId = 1
+	beingCloned.CreatedTime = startTime
+	beingCloned.Vm = &baseVM
+
+	cloned := &types.VmClonedEvent{SourceVm: baseVM}
+	cloned.Key = 2
+	cloned.ChainId = 1
+	cloned.CreatedTime = startTime.Add(90 * time.Second)
+
+	// The events are in the wrong order, since the events on a page aren't
+	// ordered either.
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{cloned, beingCloned}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	err = collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"base-image/vsphere-foo-instance/operations-clone_success", api.Derive(1)},
+		{"base-image/vsphere-foo-instance/duration-clone_min", api.Gauge(90)},
+		{"base-image/vsphere-foo-instance/duration-clone_max", api.Gauge(90)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+func TestVSphereEventListenerPowerOnDuration(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	queueTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	host := hostArg("power-host")
+
+	task := &types.TaskEvent{Info: types.TaskInfo{
+		DescriptionId: "VirtualMachine.powerOn",
+		QueueTime:     queueTime,
+		EventChainId:  1,
+	}}
+	task.Key = 1
+	task.ChainId = 1
+	task.CreatedTime = queueTime
+
+	starting := &types.VmStartingEvent{}
+	starting.Key = 2
+	starting.ChainId = 1
+	starting.CreatedTime = queueTime.Add(5 * time.Second)
+	starting.Host = &host
+
+	poweredOn := &types.VmPoweredOnEvent{}
+	poweredOn.Key = 3
+	poweredOn.ChainId = 1
+	poweredOn.CreatedTime = queueTime.Add(12 * time.Second)
+	poweredOn.Host = &host
+
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{poweredOn, starting, task}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	err = collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"power-host/vsphere-foo-instance/operations-power_on_success", api.Derive(1)},
+		{"power-host/vsphere-foo-instance/duration-power_on_min", api.Gauge(12)},
+		{"power-host/vsphere-foo-instance/duration-power_on_p95", api.Gauge(12)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+func TestVSphereEventListenerReconnect(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	vSphereURL, _ := url.Parse("https://vcenter.example.com/sdk")
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{URL: vSphereURL}, collector, nullLogger)
+	listener.minReconnectBackoff = time.Millisecond
+	listener.maxReconnectBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first connection fails after a while, the next attempt to connect
+	// fails, and the one after that succeeds.
+	var connects, runs int
+	connect := func(ctx context.Context) error {
+		connects++
+		if connects == 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	run := func(ctx context.Context) error {
+		runs++
+		if runs == 2 {
+			cancel()
+			return nil
+		}
+		return errors.New("event stream failed")
+	}
+
+	listener.runWithReconnects(ctx, connect, run)
+
+	if connects != 3 || runs != 2 {
+		t.Errorf("expected 3 attempts to connect and 2 runs, but got %d and %d", connects, runs)
+	}
+
+	err := collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	apiWriter.checkMetrics(t, []expectedMetric{{"vcenter.example.com/vsphere-foo-instance/operations-reconnect", api.Derive(1)}})
+}
+
+func TestVSphereEventListenerUnattributed(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	poweredOn := &types.VmPoweredOnEvent{}
+	poweredOn.Key = 1
+
+	poweredOff := &types.VmPoweredOffEvent{}
+	poweredOff.Key = 2
+
+	migrated := &types.VmMigratedEvent{SourceHost: hostArg("src-host")}
+	migrated.Key = 3
+
+	cloneFailed := &types.VmCloneFailedEvent{}
+	cloneFailed.Key = 4
+
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{poweredOn, poweredOff, migrated, cloneFailed}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	err = collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"unattributed/vsphere-foo-instance/operations-power_on_success", api.Derive(1)},
+		{"unattributed/vsphere-foo-instance/operations-power_off_success", api.Derive(1)},
+		{"unattributed/vsphere-foo-instance/operations-migrate_in", api.Derive(1)},
+		{"src-host/vsphere-foo-instance/operations-migrate_out", api.Derive(1)},
+		{"unattributed/vsphere-foo-instance/operations-clone_failure", api.Derive(1)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+func TestVSphereEventListenerDeduplicatesEvents(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := NewStatsCollector(apiWriter, time.Minute, nullLogger, "foo-instance")
+	defer collector.Stop()
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	host := hostArg("dedup-host")
+
+	first := &types.VmPoweredOffEvent{}
+	first.Key = 1
+	first.Host = &host
+
+	second := &types.VmPoweredOffEvent{}
+	second.Key = 2
+	second.Host = &host
+
+	// The latest page of an event collector overlaps with the previous page.
+	for _, page := range [][]types.BaseEvent{{first}, {first, second}} {
+		err := listener.handleEvents(context.Background(), page, true)
+		if err != nil {
+			t.Fatalf("handleEvents returned error: %v", err)
+		}
+	}
+
+	err := collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	apiWriter.checkMetrics(t, []expectedMetric{{"dedup-host/vsphere-foo-instance/operations-power_off_success", api.Derive(2)}})
+}
+
+type fakeEventRecorder struct {
+	records []EventRecord
+}
+
+func (r *fakeEventRecorder) RecordEvent(record EventRecord) error {
+	r.records = append(r.records, record)
+	return nil
+}
+
+func TestVSphereEventListenerRecordsEvents(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+	recorder := &fakeEventRecorder{}
+	listener.SetEventRecorder(recorder)
+
+	host := hostArg("record-host")
+	vm := vmArg("record-vm")
+
+	failed := &types.VmFailedToPowerOnEvent{}
+	failed.Key = 1
+	failed.Host = &host
+	failed.Vm = &vm
+	failed.UserName = "travis"
+	failed.Reason.LocalizedMessage = "not enough memory"
+
+	for _, page := range [][]types.BaseEvent{{failed}, {failed}} {
+		err := listener.handleEvents(context.Background(), page, true)
+		if err != nil {
+			t.Fatalf("handleEvents returned error: %v", err)
+		}
+	}
+
+	if len(recorder.records) != 1 {
+		t.Fatalf("expected 1 recorded event, got %d", len(recorder.records))
+	}
+
+	record := recorder.records[0]
+	if record.Type != "VmFailedToPowerOnEvent" || record.Host != "record-host" || record.VM != "record-vm" || record.User != "travis" || record.Fault != "not enough memory" {
+		t.Errorf("unexpected event record: %+v", record)
+	}
+}
+
+func TestVSphereEventListenerLocations(t *testing.T) {
+	apiWriter := &fakeAPIWriter{metrics: make(map[string]api.Value)}
+
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(NewCollectdLocationWriter(apiWriter), time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{}, collector, nullLogger)
+
+	host := hostArg("located-host")
+	baseVM := vmArg("located-image")
+
+	poweredOn := &types.VmPoweredOnEvent{}
+	poweredOn.Key = 1
+	poweredOn.Host = &host
+	poweredOn.ComputeResource = &types.ComputeResourceEventArgument{EntityEventArgument: types.EntityEventArgument{Name: "cluster-1"}}
+	poweredOn.Datacenter = &types.DatacenterEventArgument{EntityEventArgument: types.EntityEventArgument{Name: "dc-1"}}
+
+	cloned := &types.VmClonedEvent{SourceVm: baseVM}
+	cloned.Key = 2
+	cloned.Datacenter = &types.DatacenterEventArgument{EntityEventArgument: types.EntityEventArgument{Name: "dc-1"}}
+
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{poweredOn, cloned}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	err = collector.writeToCollectd()
+	if err != nil {
+		t.Fatalf("writeToCollectd returned error: %v", err)
+	}
+
+	expectedMetrics := []expectedMetric{
+		{"located-host/vsphere-foo-instance-dc-1-cluster-1/operations-power_on_success", api.Derive(1)},
+		{"located-image/vsphere-foo-instance-dc-1/operations-clone_success", api.Derive(1)},
+	}
+
+	apiWriter.checkMetrics(t, expectedMetrics)
+}
+
+func TestVSphereEventListenerHostMembership(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{HostRemovalGracePeriod: 10 * time.Minute}, collector, nullLogger)
+
+	removedTime := time.Now()
+	newHost := hostArg("new-host")
+	oldHost := hostArg("old-host")
+
+	collector.MarkPowerOnSuccess("old-host")
+
+	added := &types.HostAddedEvent{}
+	added.Key = 1
+	added.Host = &newHost
+
+	removed := &types.HostRemovedEvent{}
+	removed.Key = 2
+	removed.Host = &oldHost
+	removed.CreatedTime = removedTime
+
+	err := listener.handleEvents(context.Background(), []types.BaseEvent{added, removed}, true)
+	if err != nil {
+		t.Fatalf("handleEvents returned error: %v", err)
+	}
+
+	hosts := func() map[string]bool {
+		hosts := make(map[string]bool)
+		for _, metric := range collector.Metrics() {
+			if metric.EntityKind == EntityHost {
+				hosts[metric.Entity] = true
+			}
+		}
+		return hosts
+	}
+
+	if !hosts()["new-host"] {
+		t.Error("expected new-host to be reported as soon as it was added")
+	}
+	if !hosts()["old-host"] {
+		t.Error("expected old-host to still be reported during the grace period")
+	}
+
+	err = collector.writeAt(removedTime.Add(11 * time.Minute))
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
+
+	if hosts()["old-host"] {
+		t.Error("expected old-host to no longer be reported after the grace period")
+	}
+	if !hosts()["new-host"] {
+		t.Error("expected new-host to still be reported")
+	}
+}
+
+func TestVSphereEventListenerBaseVMRescan(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{BaseVMRescanInterval: 10 * time.Minute}, collector, nullLogger)
+
+	// Counters restored for base VMs that no longer exist are retired, but
+	// base VMs that are cloned from outside of the base VM folders are kept
+	// for as long as they're being cloned.
+	collector.MarkCloneSuccess("restored-image")
+	collector.MarkCloneSuccess("elsewhere-image")
+
+	listener.updateBaseVMs(map[string]string{"old-image": "dc1", "kept-image": "dc1"})
+	listener.updateBaseVMs(map[string]string{"new-image": "dc1", "kept-image": "dc1"})
+	collector.MarkCloneSuccess("elsewhere-image")
+
+	baseVMs := func() map[string]bool {
+		baseVMs := make(map[string]bool)
+		for _, metric := range collector.Metrics() {
+			if metric.EntityKind == EntityBaseVM {
+				baseVMs[metric.Entity] = true
+			}
+		}
+		return baseVMs
+	}
+
+	for _, name := range []string{"old-image", "kept-image", "new-image", "restored-image", "elsewhere-image"} {
+		if !baseVMs()[name] {
+			t.Errorf("expected %s to be reported before the next rescan", name)
+		}
+	}
+
+	err := collector.writeAt(time.Now().Add(11 * time.Minute))
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
+
+	for _, name := range []string{"old-image", "restored-image"} {
+		if baseVMs()[name] {
+			t.Errorf("expected %s to no longer be reported after the next rescan", name)
+		}
+	}
+	for _, name := range []string{"kept-image", "new-image", "elsewhere-image"} {
+		if !baseVMs()[name] {
+			t.Errorf("expected %s to still be reported", name)
+		}
+	}
+
+	// Without rescans, base VMs that are only found by being cloned are kept
+	// when reconnecting.
+	listener.config.BaseVMRescanInterval = 0
+	listener.updateBaseVMs(map[string]string{"new-image": "dc1"})
+	listener.updateBaseVMs(map[string]string{"new-image": "dc1"})
+
+	err = collector.writeAt(time.Now().Add(22 * time.Minute))
+	if err != nil {
+		t.Fatalf("writeAt returned error: %v", err)
+	}
+
+	for _, name := range []string{"kept-image", "new-image", "elsewhere-image"} {
+		if !baseVMs()[name] {
+			t.Errorf("expected %s to still be reported without rescans", name)
+		}
+	}
+}
+
+// fakeInventory is a baseVMInventory with folders and vApps that are given
+// as maps from their ID to the IDs of their children. The type of each child
+// is taken from the prefix of its ID, and VMs are named after their ID. The
+// IDs of the VMs whose config is retrieved are added to retrieved, if it isn't
+// nil.
+type fakeInventory struct {
+	folders   map[string][]string
+	vApps     map[string][]string
+	retrieved map[string]bool
+}
+
+func fakeRef(id string) types.ManagedObjectReference {
+	switch {
+	case strings.HasPrefix(id, "folder-"):
+		return types.ManagedObjectReference{Type: "Folder", Value: id}
+	case strings.HasPrefix(id, "vapp-"):
+		return types.ManagedObjectReference{Type: "VirtualApp", Value: id}
+	default:
+		return types.ManagedObjectReference{Type: "VirtualMachine", Value: id}
+	}
+}
+
+func (i fakeInventory) folderChildren(ctx context.Context, folder types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	var refs []types.ManagedObjectReference
+	for _, id := range i.folders[folder.Value] {
+		refs = append(refs, fakeRef(id))
+	}
+	return refs, nil
+}
+
+func (i fakeInventory) vAppContents(ctx context.Context, vApp types.ManagedObjectReference) ([]types.ManagedObjectReference, []types.ManagedObjectReference, error) {
+	var vms, vApps []types.ManagedObjectReference
+	for _, id := range i.vApps[vApp.Value] {
+		ref := fakeRef(id)
+		if ref.Type == "VirtualApp" {
+			vApps = append(vApps, ref)
+		} else {
+			vms = append(vms, ref)
+		}
+	}
+	return vms, vApps, nil
+}
+
+func (i fakeInventory) vmNames(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error) {
+	var mvms []mo.VirtualMachine
+	for _, ref := range vms {
+		mvms = append(mvms, mo.VirtualMachine{
+			ManagedEntity: mo.ManagedEntity{ExtensibleManagedObject: mo.ExtensibleManagedObject{Self: ref}, Name: ref.Value},
+		})
+	}
+	return mvms, nil
+}
+
+func (i fakeInventory) virtualMachines(ctx context.Context, vms []types.ManagedObjectReference) ([]mo.VirtualMachine, error) {
+	var mvms []mo.VirtualMachine
+	for _, ref := range vms {
+		if i.retrieved != nil {
+			i.retrieved[ref.Value] = true
+		}
+		mvms = append(mvms, mo.VirtualMachine{
+			ManagedEntity: mo.ManagedEntity{ExtensibleManagedObject: mo.ExtensibleManagedObject{Self: ref}, Name: ref.Value},
+			Config:        &types.VirtualMachineConfigInfo{Template: strings.HasPrefix(ref.Value, "template-")},
+		})
+	}
+	return mvms, nil
+}
+
+func TestVSphereEventListenerBaseVMFolderDepth(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	inventory := fakeInventory{
+		folders: map[string][]string{
+			"folder-base": {"vm-a", "template-a", "folder-1", "vapp-1"},
+			"folder-1":    {"vm-b", "folder-2"},
+			"folder-2":    {"vm-c", "folder-3"},
+			"folder-3":    {"vm-d"},
+		},
+		vApps: map[string][]string{
+			"vapp-1": {"vm-e", "vapp-2"},
+			"vapp-2": {"vm-f"},
+		},
+	}
+
+	tests := []struct {
+		depth    int
+		expected []string
+	}{
+		{depth: 0, expected: []string{"vm-a", "template-a"}},
+		{depth: 1, expected: []string{"vm-a", "template-a", "vm-b", "vm-e"}},
+		{depth: 2, expected: []string{"vm-a", "template-a", "vm-b", "vm-c", "vm-e", "vm-f"}},
+		{depth: -1, expected: []string{"vm-a", "template-a", "vm-b", "vm-c", "vm-d", "vm-e", "vm-f"}},
+	}
+
+	for _, test := range tests {
+		listener := NewVSphereEventListener(VSphereConfig{}, newStatsCollector(nil, time.Minute, nullLogger, "foo-instance"), nullLogger)
+
+		baseVMs := make(map[string]string)
+		err := listener.findBaseVMsInFolder(context.Background(), inventory, fakeRef("folder-base"), test.depth, nil, "dc1", baseVMs)
+		if err != nil {
+			t.Fatalf("depth %d: findBaseVMsInFolder returned error: %v", test.depth, err)
+		}
+
+		if len(baseVMs) != len(test.expected) {
+			t.Errorf("depth %d: expected base VMs %v, but got %v", test.depth, test.expected, baseVMs)
+		}
+		for _, name := range test.expected {
+			if baseVMs[name] != "dc1" {
+				t.Errorf("depth %d: expected %s to be found in dc1, but got %v", test.depth, name, baseVMs)
+			}
+		}
+	}
+}
+
+func TestVSphereEventListenerBaseVMNamePattern(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	inventory := fakeInventory{
+		folders: map[string][]string{
+			"folder-vm": {"vm-web-1", "template-base-trusty", "folder-1"},
+			"folder-1":  {"vapp-1"},
+		},
+		vApps: map[string][]string{
+			"vapp-1": {"template-base-xenial"},
+		},
+		retrieved: make(map[string]bool),
+	}
+
+	collector := newStatsCollector(nil, time.Minute, nullLogger, "foo-instance")
+	listener := NewVSphereEventListener(VSphereConfig{BaseVMNamePattern: regexp.MustCompile(`^template-base-`)}, collector, nullLogger)
+
+	// Base VMs found in a base VM folder keep their datacenter.
+	baseVMs := map[string]string{"template-base-trusty": "dc-folder"}
+	err := listener.findBaseVMsByNameInFolder(context.Background(), inventory, fakeRef("folder-vm"), "dc1", baseVMs)
+	if err != nil {
+		t.Fatalf("findBaseVMsByNameInFolder returned error: %v", err)
+	}
+
+	expected := map[string]string{"template-base-trusty": "dc-folder", "template-base-xenial": "dc1"}
+	if len(baseVMs) != len(expected) {
+		t.Errorf("expected base VMs %v, but got %v", expected, baseVMs)
+	}
+	for name, datacenterName := range expected {
+		if baseVMs[name] != datacenterName {
+			t.Errorf("expected %s to be found in %s, but got %v", name, datacenterName, baseVMs)
+		}
+	}
+
+	// Only the config of the VMs that are added is retrieved.
+	if len(inventory.retrieved) != 1 || !inventory.retrieved["template-base-xenial"] {
+		t.Errorf("expected only the config of template-base-xenial to be retrieved, but got %v", inventory.retrieved)
+	}
+}
+
+func TestVSphereEventListenerRescan(t *testing.T) {
+	nullLogger := newNullLogger()
+
+	listener := NewVSphereEventListener(VSphereConfig{}, nil, nullLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scans := 0
+	listener.rescan(ctx, time.Millisecond, "hosts", func(ctx context.Context) error {
+		scans++
+		if scans == 3 {
+			cancel()
+		}
+		return errors.New("scan failed")
+	})
+	if scans != 3 {
+		t.Errorf("expected rescan to scan until cancelled, but it scanned %d times", scans)
+	}
+
+	listener.rescan(context.Background(), 0, "hosts", func(ctx context.Context) error {
+		t.Error("expected no scans with a 0 interval")
+		return nil
+	})
+}